@@ -4,8 +4,12 @@ go 1.15
 
 require (
 	github.com/coreos/go-systemd v0.0.0-20190719114852-fd7a80b32e1f // indirect
+	github.com/creack/pty v1.1.9
+	github.com/cyphar/filepath-securejoin v0.2.3-0.20190205144030-7efe413b52e1
 	github.com/godbus/dbus v4.1.0+incompatible // indirect
+	github.com/hashicorp/consul-template v0.25.2
 	github.com/hashicorp/go-hclog v0.14.1
+	github.com/hashicorp/go-multierror v1.1.1
 	github.com/hashicorp/nomad v1.1.14
 	github.com/hashicorp/nomad/api v0.0.0-20210622141236-e978d371fa4f // indirect
 	github.com/kr/pty v1.1.8 // indirect
@@ -13,9 +17,11 @@ require (
 	github.com/onsi/ginkgo v1.12.0 // indirect
 	github.com/opencontainers/runc v1.0.0-rc93
 	github.com/stretchr/testify v1.7.0
+	golang.org/x/crypto v0.0.0-20201002170205-7f63de1d35b0
 	golang.org/x/exp v0.0.0-20191030013958-a1ab85dbe136 // indirect
 	golang.org/x/lint v0.0.0-20191125180803-fdd1cda4f05f // indirect
 	golang.org/x/mod v0.3.0 // indirect
 	golang.org/x/oauth2 v0.0.0-20200107190931-bf48bf16ab8d // indirect
 	golang.org/x/sync v0.0.0-20200317015054-43a5402ce75a // indirect
+	golang.org/x/sys v0.0.0-20220517195934-5e4e11fc645e
 )
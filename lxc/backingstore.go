@@ -0,0 +1,187 @@
+package lxc
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	lxc "github.com/lxc/go-lxc"
+)
+
+const (
+	// defaultBackingStore is the backing store liblxc creates containers
+	// with unless told otherwise
+	defaultBackingStore = "dir"
+)
+
+// backingStores maps the backing store names accepted in the driver and task
+// configs to liblxc backing stores
+var backingStores = map[string]lxc.BackendStore{
+	"dir":     lxc.Directory,
+	"overlay": lxc.Overlayfs,
+	"btrfs":   lxc.Btrfs,
+	"zfs":     lxc.ZFS,
+	"lvm":     lxc.LVM,
+	"loop":    lxc.Loopback,
+}
+
+// blockBackingStores are the backing stores that create a filesystem, and so
+// understand the filesystem type and size settings
+var blockBackingStores = map[string]bool{
+	"lvm":  true,
+	"loop": true,
+}
+
+// BackingStoreConfig is the driver configuration of container backing stores
+type BackingStoreConfig struct {
+	// Default is the backing store of tasks that don't set one
+	Default string `codec:"default"`
+
+	// Allowed lists the backing stores tasks may use; all of them if empty
+	Allowed []string `codec:"allowed"`
+
+	// FSType and FSSizeMB are the default filesystem type and size of
+	// lvm and loop backed containers
+	FSType   string `codec:"fstype"`
+	FSSizeMB int    `codec:"fssize_mb"`
+
+	// ZFSRoot is the dataset zfs backed containers are created under
+	ZFSRoot string `codec:"zfs_root"`
+
+	// LVMVG and LVMThinPool are the volume group and thin pool lvm backed
+	// containers are created in
+	LVMVG       string `codec:"lvm_vg"`
+	LVMThinPool string `codec:"lvm_thinpool"`
+}
+
+func (c *BackingStoreConfig) validate() error {
+	if c.Default == "" {
+		c.Default = defaultBackingStore
+	}
+	if _, ok := backingStores[c.Default]; !ok {
+		return fmt.Errorf("backingstore.default %q is not one of %s", c.Default, backingStoreNames())
+	}
+	for _, name := range c.Allowed {
+		if _, ok := backingStores[name]; !ok {
+			return fmt.Errorf("backingstore.allowed %q is not one of %s", name, backingStoreNames())
+		}
+	}
+	if !c.allowed(c.Default) {
+		return fmt.Errorf("backingstore.default %q is not in backingstore.allowed", c.Default)
+	}
+	if c.FSSizeMB < 0 {
+		return fmt.Errorf("backingstore.fssize_mb must not be negative")
+	}
+	return nil
+}
+
+// allowed reports whether tasks may use the named backing store
+func (c *BackingStoreConfig) allowed(name string) bool {
+	if len(c.Allowed) == 0 {
+		return true
+	}
+	for _, a := range c.Allowed {
+		if a == name {
+			return true
+		}
+	}
+	return false
+}
+
+// backingStoreNames returns the sorted names of the known backing stores
+func backingStoreNames() string {
+	names := make([]string, 0, len(backingStores))
+	for name := range backingStores {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// resolve returns the validated backing store of the task and the
+// liblxc settings to create its container with
+func (c *BackingStoreConfig) resolve(taskConfig TaskConfig) (string, lxc.BackendStore, *lxc.BackendStoreSpecs, error) {
+	name := taskConfig.BackingStore
+	if name == "" {
+		name = c.Default
+	}
+	if name == "" {
+		name = defaultBackingStore
+	}
+
+	backend, ok := backingStores[name]
+	if !ok {
+		return "", 0, nil, fmt.Errorf("lxc driver config 'backingstore' can only be one of %s", backingStoreNames())
+	}
+	if !c.allowed(name) {
+		return "", 0, nil, fmt.Errorf("lxc driver config 'backingstore' %q is not allowed on this node, allowed backing stores are %s", name, strings.Join(c.Allowed, ", "))
+	}
+
+	if !blockBackingStores[name] {
+		if taskConfig.BackingStoreFSType != "" || taskConfig.BackingStoreSizeMB != 0 {
+			return "", 0, nil, fmt.Errorf("lxc driver config 'backingstore_fstype' and 'backingstore_size_mb' are only supported by the lvm and loop backing stores")
+		}
+	}
+	if taskConfig.BackingStoreSizeMB < 0 {
+		return "", 0, nil, fmt.Errorf("lxc driver config 'backingstore_size_mb' must not be negative")
+	}
+
+	specs := &lxc.BackendStoreSpecs{
+		FSType: c.FSType,
+		FSSize: uint64(c.FSSizeMB) * 1024 * 1024,
+	}
+	if taskConfig.BackingStoreFSType != "" {
+		specs.FSType = taskConfig.BackingStoreFSType
+	}
+	if taskConfig.BackingStoreSizeMB != 0 {
+		specs.FSSize = uint64(taskConfig.BackingStoreSizeMB) * 1024 * 1024
+	}
+	specs.ZFS.Root = c.ZFSRoot
+	specs.LVM.VG = c.LVMVG
+	specs.LVM.Thinpool = c.LVMThinPool
+
+	return name, backend, specs, nil
+}
+
+// containerBackingStore returns the backing store of a created container,
+// read from the type prefix of its rootfs path
+func containerBackingStore(c *lxc.Container) string {
+	return rootfsBackingStore(c.ConfigItem("lxc.rootfs.path"))
+}
+
+// rootfsBackingStore returns the backing store of a rootfs path such as
+// "overlay:/var/lib/lxc/base/rootfs:/var/lib/lxc/c1/delta0". Paths without a
+// type prefix are directories.
+func rootfsBackingStore(paths []string) string {
+	if len(paths) == 0 || paths[0] == "" {
+		return ""
+	}
+	path := paths[0]
+	if i := strings.Index(path, ":"); i > 0 {
+		switch prefix := path[:i]; prefix {
+		case "overlayfs":
+			return "overlay"
+		default:
+			if _, ok := backingStores[prefix]; ok {
+				return prefix
+			}
+		}
+	}
+	if strings.HasPrefix(path, "/dev/") {
+		// lvm volumes are configured as bare device paths
+		return "lvm"
+	}
+	return defaultBackingStore
+}
+
+// recoveredBackingStore returns the backing store of the named container, for
+// task states that didn't record it
+func (d *Driver) recoveredBackingStore(name string) string {
+	c, err := lxc.NewContainer(name, d.lxcPath())
+	if err != nil {
+		d.logger.Warn("failed to look up backing store of recovered container", "container", name, "error", err)
+		return ""
+	}
+	defer c.Release()
+	return containerBackingStore(c)
+}
@@ -0,0 +1,189 @@
+package lxc
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	// cgroupRoot is where the cgroup hierarchies are mounted on the host
+	cgroupRoot = "/sys/fs/cgroup"
+)
+
+// memoryCgroup identifies the memory cgroup of a container on the host
+type memoryCgroup struct {
+	// dir is the host path of the cgroup directory
+	dir string
+
+	// v2 is true if dir is on the unified (cgroup v2) hierarchy
+	v2 bool
+}
+
+// procCgroupPath returns the host path of the cgroup that pid belongs to for
+// the given cgroup v1 controller, or on the unified hierarchy if the
+// controller isn't mounted as a v1 hierarchy. The second return value is true
+// for the unified hierarchy.
+func procCgroupPath(pid int, controller string) (string, bool, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return "", false, err
+	}
+	defer f.Close()
+
+	unified := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// hierarchy-ID:controller-list:cgroup-path
+		parts := strings.SplitN(scanner.Text(), ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+
+		if parts[0] == "0" && parts[1] == "" {
+			unified = parts[2]
+			continue
+		}
+
+		for _, c := range strings.Split(parts[1], ",") {
+			if c != "" && c == controller {
+				return filepath.Join(cgroupRoot, controller, parts[2]), false, nil
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", false, err
+	}
+
+	if unified == "" {
+		return "", false, fmt.Errorf("no %s cgroup found for pid %d", controller, pid)
+	}
+	return filepath.Join(unifiedCgroupRoot(), unified), true, nil
+}
+
+// unifiedCgroupRoot returns the mount point of the cgroup v2 hierarchy, which
+// is cgroupRoot itself on unified hosts and a subdirectory on hybrid hosts
+func unifiedCgroupRoot() string {
+	if _, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers")); err == nil {
+		return cgroupRoot
+	}
+	return filepath.Join(cgroupRoot, "unified")
+}
+
+// procUnifiedCgroupPath returns the host path of the cgroup v2 cgroup of pid
+func procUnifiedCgroupPath(pid int) (string, error) {
+	dir, v2, err := procCgroupPath(pid, "")
+	if err != nil {
+		return "", err
+	}
+	if !v2 {
+		return "", fmt.Errorf("pid %d is not on the unified cgroup hierarchy", pid)
+	}
+	return dir, nil
+}
+
+// containerMemoryCgroup looks up the memory cgroup of the container init pid
+func containerMemoryCgroup(pid int) (*memoryCgroup, error) {
+	dir, v2, err := procCgroupPath(pid, "memory")
+	if err != nil {
+		return nil, err
+	}
+	return &memoryCgroup{dir: dir, v2: v2}, nil
+}
+
+// oomKillCount returns the number of processes in the cgroup killed by the
+// OOM killer, read from memory.events on cgroup v2 or memory.oom_control on v1
+func (m *memoryCgroup) oomKillCount() (uint64, error) {
+	file := "memory.oom_control"
+	if m.v2 {
+		file = "memory.events"
+	}
+
+	buf, err := ioutil.ReadFile(filepath.Join(m.dir, file))
+	if err != nil {
+		return 0, err
+	}
+
+	return parseOOMKillCount(string(buf))
+}
+
+// parseOOMKillCount extracts the oom_kill counter from the flat keyed
+// contents of memory.events or memory.oom_control
+func parseOOMKillCount(contents string) (uint64, error) {
+	for _, line := range strings.Split(contents, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "oom_kill" {
+			return strconv.ParseUint(fields[1], 10, 64)
+		}
+	}
+	return 0, fmt.Errorf("oom_kill counter not found")
+}
+
+// cgroupPids returns the pids of all processes in the cgroup of pid and its
+// descendant cgroups
+func cgroupPids(pid int) ([]int, error) {
+	// any v1 controller will do; every container process is in the container
+	// cgroup of each hierarchy
+	dir, _, err := procCgroupPath(pid, "pids")
+	if err != nil {
+		return nil, err
+	}
+
+	var pids []int
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || info.Name() != "cgroup.procs" {
+			return nil
+		}
+
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		for _, line := range strings.Fields(string(buf)) {
+			p, err := strconv.Atoi(line)
+			if err != nil {
+				return fmt.Errorf("invalid pid %q in %s", line, path)
+			}
+			pids = append(pids, p)
+		}
+		return nil
+	})
+
+	return pids, err
+}
+
+// pidInContainerCgroup reports whether pid is in a cgroup of the named
+// container. liblxc names container cgroups after the container (for example
+// lxc.payload.<name> or lxc/<name>), unless lxc.cgroup.dir is set to cgroupDir.
+func pidInContainerCgroup(pid int, name, cgroupDir string) (bool, error) {
+	buf, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return false, err
+	}
+
+	for _, line := range strings.Split(string(buf), "\n") {
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		path := parts[2]
+
+		if cgroupDir != "" && strings.Contains(path, strings.Trim(cgroupDir, "/")) {
+			return true, nil
+		}
+		for _, elem := range strings.Split(path, "/") {
+			if elem == name || strings.HasSuffix(elem, "."+name) {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
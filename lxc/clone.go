@@ -0,0 +1,183 @@
+package lxc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	lxc "github.com/lxc/go-lxc"
+)
+
+const (
+	// baseContainerPrefix prefixes the names of base containers; these never
+	// match the names of task containers, so the reaper leaves them alone
+	baseContainerPrefix = "nomad-base-"
+
+	// baseReadyFile is written in the directory of a base container once its
+	// rootfs is complete
+	baseReadyFile = "nomad-base-ready"
+)
+
+// snapshotBackends are the backing stores liblxc can take snapshots with
+var snapshotBackends = map[string]lxc.BackendStore{
+	"overlay": lxc.Overlayfs,
+	"btrfs":   lxc.Btrfs,
+	"zfs":     lxc.ZFS,
+	"lvm":     lxc.LVM,
+}
+
+// CloneConfig configures the creation of task containers by cloning a base
+// container prepared once per image
+type CloneConfig struct {
+	Enabled bool `codec:"enabled"`
+
+	// Backend is the backing store used to snapshot base containers: one of
+	// overlay, btrfs, zfs or lvm
+	Backend string `codec:"backend"`
+}
+
+func (c *CloneConfig) validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if _, ok := snapshotBackends[c.Backend]; !ok {
+		return fmt.Errorf("clone.backend can only be one of overlay, btrfs, zfs or lvm")
+	}
+	return nil
+}
+
+// baseBackend returns the backing store of base containers. Overlay snapshots
+// are taken of directory backed containers, while the other backends snapshot
+// containers of their own kind.
+func (c *CloneConfig) baseBackend() lxc.BackendStore {
+	backend := snapshotBackends[c.Backend]
+	if backend == lxc.Overlayfs {
+		return lxc.Directory
+	}
+	return backend
+}
+
+// baseContainerName returns the name of the base container for containers
+// created with opts and defaultConfig. Everything that shapes the rootfs or
+// the saved config is part of the name, so a base is only shared by
+// identically created containers.
+func baseContainerName(opts lxc.TemplateOptions, defaultConfig, backend string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%q %q %q %q %q %q %q %q %q %q",
+		opts.Template, opts.Distro, opts.Release, opts.Arch, opts.Variant,
+		opts.Server, strings.Join(opts.ExtraArgs, " "), defaultConfig, backend,
+		fmt.Sprint(opts.DisableGPGValidation))
+	sum := hex.EncodeToString(h.Sum(nil))[:12]
+
+	if opts.Distro == "" {
+		return fmt.Sprintf("%s%s-%s", baseContainerPrefix, filepath.Base(opts.Template), sum)
+	}
+	return fmt.Sprintf("%s%s-%s-%s-%s", baseContainerPrefix, opts.Distro, opts.Release, opts.Arch, sum)
+}
+
+// cloneEnabled reports whether the task container should be cloned from a
+// base container. Flushing the cache asks for a fresh rootfs, which a base
+// container can't provide, and tasks asking for a backing store get a
+// container of their own. OCI images are unpacked from the task directory, so
+// their containers can't be shared, and a rootfs and ephemeral containers are
+// shared through an overlay already.
+func (d *Driver) cloneEnabled(taskConfig TaskConfig, opts lxc.TemplateOptions) bool {
+	return d.currentConfig().Clone.Enabled && !opts.FlushCache && taskConfig.BackingStore == "" &&
+		taskConfig.Rootfs == "" && opts.Template != ociTemplate && !taskConfig.Ephemeral
+}
+
+// cloneFromBase creates the named container as a clone of the base container
+// for opts, creating the base container first if needed. The clone is a
+// snapshot with the configured backend, or a full copy if the backend can't
+// snapshot the base. It returns the name of the base container, and the
+// verification of its image if the base container was created.
+func (d *Driver) cloneFromBase(ctx context.Context, name string, opts lxc.TemplateOptions, defaultConfig string) (string, *imageVerification, error) {
+	lxcPath := d.lxcPath()
+	baseName := baseContainerName(opts, defaultConfig, d.currentConfig().Clone.Backend)
+
+	unlock := d.bases.lock(baseName)
+	base, v, err := d.prepareBaseContainer(ctx, baseName, opts, defaultConfig, d.currentConfig().Clone.baseBackend())
+	unlock()
+	if err != nil {
+		return baseName, v, fmt.Errorf("failed to prepare base container %q: %v", baseName, err)
+	}
+	defer base.Release()
+
+	err = base.Clone(name, lxc.CloneOptions{
+		Backend:    snapshotBackends[d.currentConfig().Clone.Backend],
+		ConfigPath: lxcPath,
+		Snapshot:   true,
+	})
+	if err == nil {
+		return baseName, v, nil
+	}
+
+	d.logger.Warn("failed to snapshot base container, falling back to a full copy",
+		"base", baseName, "backend", d.currentConfig().Clone.Backend, "error", err)
+	if err := destroyContainer(name, lxcPath); err != nil {
+		return baseName, v, fmt.Errorf("failed to clean up failed snapshot: %v", err)
+	}
+
+	err = base.Clone(name, lxc.CloneOptions{
+		Backend:    lxc.Directory,
+		ConfigPath: lxcPath,
+	})
+	if err != nil {
+		destroyContainer(name, lxcPath)
+		return baseName, v, fmt.Errorf("failed to copy base container %q: %v", baseName, err)
+	}
+	return baseName, v, nil
+}
+
+// prepareBaseContainer returns the named base container, creating it with
+// opts and the given backend if it doesn't exist or if its creation was
+// interrupted. It must be called with the base container locked. The
+// verification of the image is returned if the base container was created.
+func (d *Driver) prepareBaseContainer(ctx context.Context, name string, opts lxc.TemplateOptions, defaultConfig string, backend lxc.BackendStore) (*lxc.Container, *imageVerification, error) {
+	lxcPath := d.lxcPath()
+	readyPath := filepath.Join(lxcPath, name, baseReadyFile)
+
+	c, err := lxc.NewContainer(name, lxcPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if c.Defined() {
+		if _, err := os.Stat(readyPath); err == nil {
+			return c, nil, nil
+		}
+
+		d.logger.Warn("destroying incomplete base container", "base", name)
+		if err := c.Destroy(); err != nil {
+			c.Release()
+			return nil, nil, err
+		}
+	}
+
+	if err := c.LoadConfigFile(defaultConfig); err != nil {
+		d.logger.Warn("failed to load default config", "path", defaultConfig, "error", err)
+	}
+
+	d.logger.Info("creating base container", "base", name)
+	opts.Backend = backend
+	opts.BackendSpecs = nil
+	created, err := d.createRootfs(ctx, c, opts)
+	if err != nil {
+		d.destroyPartialContainer(name, err)
+		if !isTemplateStuck(err) {
+			c.Release()
+		}
+		return nil, created.verification, err
+	}
+
+	if err := ioutil.WriteFile(readyPath, nil, 0644); err != nil {
+		c.Release()
+		return nil, created.verification, err
+	}
+	return c, created.verification, nil
+}
@@ -0,0 +1,266 @@
+package lxc
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+	lxc "github.com/lxc/go-lxc"
+)
+
+const (
+	// defaultCreateTimeout bounds the creation of the container rootfs if
+	// the driver config doesn't set create_timeout
+	defaultCreateTimeout = 30 * time.Minute
+
+	// templateKillWait is how long to wait for liblxc to return once the
+	// template has been killed
+	templateKillWait = 30 * time.Second
+)
+
+// parseCreateTimeout parses the create_timeout of the driver or task config.
+// Zero disables the timeout.
+func parseCreateTimeout(value string, def time.Duration) (time.Duration, error) {
+	if value == "" {
+		return def, nil
+	}
+	dur, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid create_timeout %q: %v", value, err)
+	}
+	if dur < 0 {
+		return 0, fmt.Errorf("create_timeout must not be negative")
+	}
+	return dur, nil
+}
+
+// startingTasks tracks the cancel functions of the tasks being started, so
+// that a task killed before StartTask returns stops creating its container
+type startingTasks struct {
+	lock    sync.Mutex
+	cancels map[string]context.CancelFunc
+}
+
+func newStartingTasks() *startingTasks {
+	return &startingTasks{cancels: make(map[string]context.CancelFunc)}
+}
+
+// add registers the cancel function of the starting task and returns a
+// function that unregisters it
+func (s *startingTasks) add(id string, cancel context.CancelFunc) func() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.cancels[id] = cancel
+	return func() {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		delete(s.cancels, id)
+	}
+}
+
+// cancel cancels the start of the task and reports whether it was starting
+func (s *startingTasks) cancel(id string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	cancel, ok := s.cancels[id]
+	if ok {
+		cancel()
+	}
+	return ok
+}
+
+// createContext returns the context bounding the creation of the container
+// of a task. It is cancelled when the create timeout elapses, the driver
+// shuts down or the task is killed.
+func (d *Driver) createContext(cfg *drivers.TaskConfig, taskConfig TaskConfig) (context.Context, time.Duration, func(), error) {
+	timeout, err := parseCreateTimeout(taskConfig.CreateTimeout, d.currentConfig().createTimeout)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(d.ctx, timeout)
+	} else {
+		ctx, cancel = context.WithCancel(d.ctx)
+	}
+	remove := d.starting.add(cfg.ID, cancel)
+	return ctx, timeout, func() {
+		remove()
+		cancel()
+	}, nil
+}
+
+// createError returns the error to report for a failed container creation,
+// distinguishing a timeout and a cancellation from a template failure. All
+// of them are recoverable.
+func createError(ctx context.Context, timeout time.Duration, err error) error {
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		return fmt.Errorf("timed out creating container after %s", timeout)
+	case context.Canceled:
+		return fmt.Errorf("container creation cancelled")
+	}
+	return err
+}
+
+// templateStuckError is returned by createContainer if the template didn't
+// exit once killed. c.Create is still running and holds the lock of the
+// container, so the container must neither be used nor cleaned up.
+type templateStuckError struct {
+	name string
+	err  error
+}
+
+func (e *templateStuckError) Error() string {
+	return fmt.Sprintf("%v; template of container %s did not exit", e.err, e.name)
+}
+
+// isTemplateStuck reports whether err is a templateStuckError
+func isTemplateStuck(err error) bool {
+	_, ok := err.(*templateStuckError)
+	return ok
+}
+
+// createContainer runs c.Create with opts. liblxc can't interrupt a running
+// template, so if ctx is done first the template is killed for Create to
+// return. c is locked until Create returns, so the name of the container is
+// read beforehand.
+func createContainer(ctx context.Context, c *lxc.Container, opts lxc.TemplateOptions) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	name := c.Name()
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Create(opts)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+	}
+
+	// the template may spawn more processes while it is being killed
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	deadline := time.After(templateKillWait)
+	for {
+		killTemplate(name)
+		select {
+		case <-done:
+			return ctx.Err()
+		case <-deadline:
+			return &templateStuckError{name: name, err: ctx.Err()}
+		case <-ticker.C:
+		}
+	}
+}
+
+// killTemplate kills the template process creating the named container and
+// all of its descendants. liblxc runs the template as a child of this
+// process with the container name as its --name argument.
+func killTemplate(name string) {
+	procs, err := listProcs()
+	if err != nil {
+		return
+	}
+
+	self := os.Getpid()
+	for pid, ppid := range procs {
+		if ppid != self || !isTemplateOf(pid, name) {
+			continue
+		}
+		for _, p := range procTree(procs, pid) {
+			syscall.Kill(p, syscall.SIGKILL)
+		}
+	}
+}
+
+// isTemplateOf reports whether the command line of pid has the argument
+// --name followed by name
+func isTemplateOf(pid int, name string) bool {
+	buf, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return false
+	}
+	args := strings.Split(string(buf), "\x00")
+	for i := 0; i+1 < len(args); i++ {
+		if (args[i] == "--name" && args[i+1] == name) || args[i] == "--name="+name {
+			return true
+		}
+	}
+	return false
+}
+
+// listProcs returns the parent pid of every process, by pid
+func listProcs() (map[int]int, error) {
+	entries, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+
+	procs := make(map[int]int, len(entries))
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		buf, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+		if err != nil {
+			// the process exited
+			continue
+		}
+		ppid, err := parseProcStatPpid(string(buf))
+		if err != nil {
+			continue
+		}
+		procs[pid] = ppid
+	}
+	return procs, nil
+}
+
+// procTree returns root and all of its descendants in procs, which maps pids
+// to parent pids. Parents come before their children.
+func procTree(procs map[int]int, root int) []int {
+	children := make(map[int][]int)
+	for pid, ppid := range procs {
+		children[ppid] = append(children[ppid], pid)
+	}
+
+	tree := []int{root}
+	for i := 0; i < len(tree); i++ {
+		tree = append(tree, children[tree[i]]...)
+	}
+	return tree
+}
+
+// destroyPartialContainer removes what a creation that failed with createErr
+// left of the named container. The template may not have written the
+// container config, in which case liblxc doesn't know the container, so the
+// container directory is removed as well. Nothing is removed while the
+// template is still running; the next creation of the container cleans up.
+func (d *Driver) destroyPartialContainer(name string, createErr error) {
+	if isTemplateStuck(createErr) {
+		d.logger.Error("not destroying partially created container, its template is still running", "container", name)
+		return
+	}
+
+	if err := destroyContainer(name, d.lxcPath()); err != nil {
+		d.logger.Warn("failed to destroy partially created container", "container", name, "error", err)
+	}
+	if err := os.RemoveAll(filepath.Join(d.lxcPath(), name)); err != nil {
+		d.logger.Warn("failed to remove partially created container", "container", name, "error", err)
+	}
+}
@@ -0,0 +1,204 @@
+package lxc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	ctestutil "github.com/hashicorp/nomad/client/testutil"
+	"github.com/hashicorp/nomad/helper/testlog"
+	"github.com/hashicorp/nomad/helper/uuid"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/hashicorp/nomad/testutil"
+	lxc "github.com/lxc/go-lxc"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLXCDriver_ParseCreateTimeout(t *testing.T) {
+	t.Parallel()
+
+	timeout, err := parseCreateTimeout("", defaultCreateTimeout)
+	require.NoError(t, err)
+	require.Equal(t, defaultCreateTimeout, timeout)
+
+	timeout, err = parseCreateTimeout("90s", defaultCreateTimeout)
+	require.NoError(t, err)
+	require.Equal(t, 90*time.Second, timeout)
+
+	// zero disables the timeout
+	timeout, err = parseCreateTimeout("0", defaultCreateTimeout)
+	require.NoError(t, err)
+	require.Zero(t, timeout)
+
+	_, err = parseCreateTimeout("-1m", defaultCreateTimeout)
+	require.EqualError(t, err, "create_timeout must not be negative")
+
+	_, err = parseCreateTimeout("soon", defaultCreateTimeout)
+	require.Error(t, err)
+}
+
+func TestLXCDriver_CreateContext(t *testing.T) {
+	t.Parallel()
+
+	d := NewLXCDriver(testlog.HCLogger(t)).(*Driver)
+	d.config.createTimeout = time.Hour
+	task := &drivers.TaskConfig{ID: uuid.Generate(), Name: "test"}
+
+	// the task overrides the driver timeout
+	ctx, timeout, done, err := d.createContext(task, TaskConfig{CreateTimeout: "10ms"})
+	require.NoError(t, err)
+	require.Equal(t, 10*time.Millisecond, timeout)
+	<-ctx.Done()
+	require.EqualError(t, createError(ctx, timeout, errors.New("template failed")),
+		"timed out creating container after 10ms")
+	done()
+	require.False(t, d.starting.cancel(task.ID))
+
+	// killing the starting task cancels the creation
+	ctx, timeout, done, err = d.createContext(task, TaskConfig{})
+	require.NoError(t, err)
+	require.Equal(t, time.Hour, timeout)
+	require.True(t, d.starting.cancel(task.ID))
+	<-ctx.Done()
+	require.EqualError(t, createError(ctx, timeout, nil), "container creation cancelled")
+	done()
+
+	// template failures are reported as is
+	ctx, timeout, done, err = d.createContext(task, TaskConfig{})
+	require.NoError(t, err)
+	defer done()
+	require.EqualError(t, createError(ctx, timeout, errors.New("template failed")), "template failed")
+
+	_, _, _, err = d.createContext(task, TaskConfig{CreateTimeout: "-1s"})
+	require.Error(t, err)
+}
+
+func TestLXCDriver_CreateContextShutdown(t *testing.T) {
+	t.Parallel()
+
+	d := NewLXCDriver(testlog.HCLogger(t)).(*Driver)
+	task := &drivers.TaskConfig{ID: uuid.Generate(), Name: "test"}
+
+	ctx, _, done, err := d.createContext(task, TaskConfig{})
+	require.NoError(t, err)
+	defer done()
+
+	require.NoError(t, d.Shutdown(context.Background()))
+	<-ctx.Done()
+	require.Equal(t, context.Canceled, ctx.Err())
+}
+
+func TestLXCDriver_CreateContainerKillsTemplate(t *testing.T) {
+	t.Parallel()
+	requireLXC(t)
+	ctestutil.RequireRoot(t)
+
+	dir, err := ioutil.TempDir("", "lxc-create")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// the template doesn't exec so that its --name argument stays visible
+	template := filepath.Join(dir, "lxc-sleep")
+	require.NoError(t, ioutil.WriteFile(template, []byte("#!/bin/sh\nsleep 600\n"), 0755))
+
+	d := NewLXCDriver(testlog.HCLogger(t)).(*Driver)
+	d.config.LXCPath = filepath.Join(dir, "lxc")
+	require.NoError(t, os.MkdirAll(d.lxcPath(), 0755))
+
+	name := "test-" + uuid.Generate()
+	c, err := lxc.NewContainer(name, d.lxcPath())
+	require.NoError(t, err)
+	defer c.Release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	start := time.Now()
+	err = createContainer(ctx, c, lxc.TemplateOptions{Template: template})
+	require.Equal(t, context.DeadlineExceeded, err)
+	require.Less(t, int64(time.Since(start)), int64(templateKillWait))
+
+	d.destroyPartialContainer(name, err)
+	require.NoDirExists(t, filepath.Join(d.lxcPath(), name))
+}
+
+func TestLXCDriver_KillTemplate(t *testing.T) {
+	t.Parallel()
+
+	// a template run by liblxc, with a child of its own
+	name := "test-" + uuid.Generate()
+	args := []string{"/bin/sh", "-c", "sleep 600; true", "lxc-test", "--name", name}
+	p, err := os.StartProcess(args[0], args, &os.ProcAttr{})
+	require.NoError(t, err)
+
+	// templates of other containers are left alone
+	killTemplate("other")
+
+	testutil.WaitForResult(func() (bool, error) {
+		procs, err := listProcs()
+		if err != nil {
+			return false, err
+		}
+		if n := len(procTree(procs, p.Pid)); n != 2 {
+			return false, fmt.Errorf("template has %d processes", n)
+		}
+		return true, nil
+	}, func(err error) {
+		t.Fatalf("template did not start: %v", err)
+	})
+
+	killTemplate(name)
+	state, err := p.Wait()
+	require.NoError(t, err)
+	require.Equal(t, syscall.SIGKILL, state.Sys().(syscall.WaitStatus).Signal())
+}
+
+func TestLXCDriver_DestroyPartialContainerTemplateStuck(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "lxc-create")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	d := NewLXCDriver(testlog.HCLogger(t)).(*Driver)
+	d.config.LXCPath = dir
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "test"), 0755))
+
+	// the template may still write into the container directory
+	stuck := &templateStuckError{name: "test", err: context.DeadlineExceeded}
+	require.EqualError(t, stuck, "context deadline exceeded; template of container test did not exit")
+	d.destroyPartialContainer("test", stuck)
+	require.DirExists(t, filepath.Join(dir, "test"))
+}
+
+func TestLXCDriver_ProcTree(t *testing.T) {
+	t.Parallel()
+
+	procs := map[int]int{
+		1:  0,
+		10: 1,
+		20: 10,
+		21: 10,
+		30: 20,
+		40: 1,
+	}
+	require.ElementsMatch(t, []int{10, 20, 21, 30}, procTree(procs, 10))
+	require.Equal(t, []int{30}, procTree(procs, 30))
+}
+
+func TestLXCDriver_ParseProcStatPpid(t *testing.T) {
+	t.Parallel()
+
+	ppid, err := parseProcStatPpid("4242 (lxc (init)) S 4241 4242 4242 0 -1")
+	require.NoError(t, err)
+	require.Equal(t, 4241, ppid)
+
+	_, err = parseProcStatPpid("4242 (init) S")
+	require.Error(t, err)
+}
@@ -2,9 +2,14 @@ package lxc
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"os"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/hashicorp/consul-template/signals"
 	hclog "github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/nomad-driver-lxc/version"
 	"github.com/hashicorp/nomad/client/stats"
@@ -26,7 +31,10 @@ const (
 
 	// taskHandleVersion is the version of task handle which this driver sets
 	// and understands how to decode driver state
-	taskHandleVersion = 1
+	//
+	// Version 2 added the resolved network mode and mounts, and the terminal
+	// state of the task.
+	taskHandleVersion = 2
 )
 
 var (
@@ -65,57 +73,165 @@ var (
 				hclspec.NewAttr("container", "bool", false),
 				hclspec.NewLiteral("true"),
 			),
+			"orphans": hclspec.NewDefault(
+				hclspec.NewAttr("orphans", "bool", false),
+				hclspec.NewLiteral("true"),
+			),
+			"orphan_grace_period": hclspec.NewDefault(
+				hclspec.NewAttr("orphan_grace_period", "string", false),
+				hclspec.NewLiteral(`"1h"`),
+			),
+			"orphan_interval": hclspec.NewDefault(
+				hclspec.NewAttr("orphan_interval", "string", false),
+				hclspec.NewLiteral(`"5m"`),
+			),
+			"keep_failed": hclspec.NewDefault(
+				hclspec.NewAttr("keep_failed", "string", false),
+				hclspec.NewLiteral(`"0s"`),
+			),
+			"keep_last": hclspec.NewDefault(
+				hclspec.NewAttr("keep_last", "number", false),
+				hclspec.NewLiteral("0"),
+			),
+			"max_disk_mb": hclspec.NewDefault(
+				hclspec.NewAttr("max_disk_mb", "number", false),
+				hclspec.NewLiteral("0"),
+			),
 		})), hclspec.NewLiteral(`{
 			container = true
+			orphans = true
+			orphan_grace_period = "1h"
+			orphan_interval = "5m"
+			keep_failed = "0s"
+			keep_last = 0
+			max_disk_mb = 0
+		}`)),
+		// driver managed cache of the download template
+		"image_cache": hclspec.NewDefault(hclspec.NewBlock("image_cache", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"dir": hclspec.NewAttr("dir", "string", false),
+			"max_size_mb": hclspec.NewDefault(
+				hclspec.NewAttr("max_size_mb", "number", false),
+				hclspec.NewLiteral("0"),
+			),
+		})), hclspec.NewLiteral(`{
+			max_size_mb = 0
+		}`)),
+		// cloning of task containers from base containers
+		"clone": hclspec.NewDefault(hclspec.NewBlock("clone", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"enabled": hclspec.NewDefault(
+				hclspec.NewAttr("enabled", "bool", false),
+				hclspec.NewLiteral("false"),
+			),
+			"backend": hclspec.NewDefault(
+				hclspec.NewAttr("backend", "string", false),
+				hclspec.NewLiteral(`"overlay"`),
+			),
+		})), hclspec.NewLiteral(`{
+			enabled = false
+			backend = "overlay"
+		}`)),
+		// local keyring to verify downloaded images against, instead of
+		// fetching the signing key from a key server
+		"gpg_keyring": hclspec.NewAttr("gpg_keyring", "string", false),
+		// images to download into the cache when the driver starts, as
+		// distro/release/arch[/variant]
+		"prepull": hclspec.NewAttr("prepull", "list(string)", false),
+		// bound on the creation of the container rootfs, "0" for none
+		"create_timeout": hclspec.NewDefault(
+			hclspec.NewAttr("create_timeout", "string", false),
+			hclspec.NewLiteral(`"30m"`),
+		),
+		// backing stores of task containers
+		"backingstore": hclspec.NewDefault(hclspec.NewBlock("backingstore", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"default": hclspec.NewDefault(
+				hclspec.NewAttr("default", "string", false),
+				hclspec.NewLiteral(`"dir"`),
+			),
+			"allowed":      hclspec.NewAttr("allowed", "list(string)", false),
+			"fstype":       hclspec.NewAttr("fstype", "string", false),
+			"fssize_mb":    hclspec.NewAttr("fssize_mb", "number", false),
+			"zfs_root":     hclspec.NewAttr("zfs_root", "string", false),
+			"lvm_vg":       hclspec.NewAttr("lvm_vg", "string", false),
+			"lvm_thinpool": hclspec.NewAttr("lvm_thinpool", "string", false),
+		})), hclspec.NewLiteral(`{
+			default = "dir"
 		}`)),
 	})
 
 	// taskConfigSpec is the hcl specification for the driver config section of
 	// a task within a job. It is returned in the TaskConfigSchema RPC
 	taskConfigSpec = hclspec.NewObject(map[string]*hclspec.Spec{
-		"template":       hclspec.NewAttr("template", "string", true),
-		"distro":         hclspec.NewAttr("distro", "string", false),
-		"release":        hclspec.NewAttr("release", "string", false),
-		"arch":           hclspec.NewAttr("arch", "string", false),
-		"image_variant":  hclspec.NewAttr("image_variant", "string", false),
-		"image_server":   hclspec.NewAttr("image_server", "string", false),
-		"gpg_key_id":     hclspec.NewAttr("gpg_key_id", "string", false),
-		"gpg_key_server": hclspec.NewAttr("gpg_key_server", "string", false),
-		"disable_gpg":    hclspec.NewAttr("disable_gpg", "string", false),
-		"flush_cache":    hclspec.NewAttr("flush_cache", "string", false),
-		"force_cache":    hclspec.NewAttr("force_cache", "string", false),
-		"template_args":  hclspec.NewAttr("template_args", "list(string)", false),
-		"log_level":      hclspec.NewAttr("log_level", "string", false),
-		"verbosity":      hclspec.NewAttr("verbosity", "string", false),
-		"volumes":        hclspec.NewAttr("volumes", "list(string)", false),
-		"network_mode":   hclspec.NewAttr("network_mode", "string", false),
-		"command":        hclspec.NewAttr("command", "list(string)", false),
-		"environment":    hclspec.NewAttr("environment", "list(string)", false),
-		"cgroup":	  hclspec.NewAttr("cgroup", "string", false),
-		"portmap":        hclspec.NewAttr("portmap", "list(map(number))", false),
+		"template":             hclspec.NewAttr("template", "string", false),
+		"distro":               hclspec.NewAttr("distro", "string", false),
+		"release":              hclspec.NewAttr("release", "string", false),
+		"arch":                 hclspec.NewAttr("arch", "string", false),
+		"image_variant":        hclspec.NewAttr("image_variant", "string", false),
+		"image_server":         hclspec.NewAttr("image_server", "string", false),
+		"gpg_key_id":           hclspec.NewAttr("gpg_key_id", "string", false),
+		"gpg_key_server":       hclspec.NewAttr("gpg_key_server", "string", false),
+		"disable_gpg":          hclspec.NewAttr("disable_gpg", "string", false),
+		"flush_cache":          hclspec.NewAttr("flush_cache", "string", false),
+		"force_cache":          hclspec.NewAttr("force_cache", "string", false),
+		"template_args":        hclspec.NewAttr("template_args", "list(string)", false),
+		"log_level":            hclspec.NewAttr("log_level", "string", false),
+		"verbosity":            hclspec.NewAttr("verbosity", "string", false),
+		"volumes":              hclspec.NewAttr("volumes", "list(string)", false),
+		"network_mode":         hclspec.NewAttr("network_mode", "string", false),
+		"command":              hclspec.NewAttr("command", "list(string)", false),
+		"environment":          hclspec.NewAttr("environment", "list(string)", false),
+		"cgroup":               hclspec.NewAttr("cgroup", "string", false),
+		"portmap":              hclspec.NewAttr("portmap", "list(map(number))", false),
+		"signal_all_processes": hclspec.NewAttr("signal_all_processes", "bool", false),
+		"restart_mode":         hclspec.NewAttr("restart_mode", "string", false),
+		"boot_mode":            hclspec.NewAttr("boot_mode", "string", false),
+		"halt_signal":          hclspec.NewAttr("halt_signal", "string", false),
+		"stop_signal":          hclspec.NewAttr("stop_signal", "string", false),
+		"backingstore":         hclspec.NewAttr("backingstore", "string", false),
+		"backingstore_fstype":  hclspec.NewAttr("backingstore_fstype", "string", false),
+		"backingstore_size_mb": hclspec.NewAttr("backingstore_size_mb", "number", false),
+		"oci_image":            hclspec.NewAttr("oci_image", "string", false),
+		"rootfs":               hclspec.NewAttr("rootfs", "string", false),
+		"rootfs_checksum":      hclspec.NewAttr("rootfs_checksum", "string", false),
+		"create_timeout":       hclspec.NewAttr("create_timeout", "string", false),
+		"ephemeral":            hclspec.NewAttr("ephemeral", "bool", false),
+		"ephemeral_storage":    hclspec.NewAttr("ephemeral_storage", "string", false),
+		"provision": hclspec.NewBlock("provision", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"file": hclspec.NewBlockList("file", hclspec.NewObject(map[string]*hclspec.Spec{
+				"source":      hclspec.NewAttr("source", "string", true),
+				"destination": hclspec.NewAttr("destination", "string", true),
+			})),
+			"commands": hclspec.NewAttr("commands", "list(list(string))", false),
+		})),
 	})
 
 	// capabilities is returned by the Capabilities RPC and indicates what
 	// optional features this driver supports
 	capabilities = &drivers.Capabilities{
-		SendSignals: false,
-		Exec:        false,
+		SendSignals: true,
+		Exec:        true,
 		FSIsolation: drivers.FSIsolationImage,
 	}
 )
 
+var _ drivers.ExecTaskStreamingRawDriver = (*Driver)(nil)
+
 // Driver is a driver for running LXC containers
 type Driver struct {
 	// eventer is used to handle multiplexing of TaskEvents calls such that an
 	// event can be broadcast to all callers
 	eventer *eventer.Eventer
 
-	// config is the driver configuration set by the SetConfig RPC
+	// config is the driver configuration set by the SetConfig RPC. It is
+	// replaced rather than modified, and read with currentConfig outside of
+	// tests as the reaper and the pre-pull run concurrently with SetConfig.
 	config *Config
 
 	// nomadConfig is the client config from nomad
 	nomadConfig *base.ClientDriverConfig
 
+	// configLock guards config, nomadConfig and imageCache
+	configLock sync.RWMutex
+
 	// tasks is the in memory datastore mapping taskIDs to rawExecDriverHandles
 	tasks *taskStore
 
@@ -127,6 +243,32 @@ type Driver struct {
 	// ctx passed to any subsystems
 	signalShutdown context.CancelFunc
 
+	// reaper destroys orphaned containers; it is started by the first
+	// SetConfig call
+	reaper     *orphanReaper
+	reaperOnce sync.Once
+
+	// prepulled holds the images pre-pulled since the driver started, so
+	// that SetConfig only pre-pulls the images it adds and those that failed
+	prepulled *prepullSet
+
+	// imageCache serializes image downloads of the download template; it is
+	// nil unless image_cache.dir is set
+	imageCache *imageCache
+
+	// bases serializes the creation of base containers to clone tasks from
+	bases *keyedMutex
+
+	// rootfsLocks serializes the unpacking of each rootfs tarball
+	rootfsLocks *keyedMutex
+
+	// imageFetchLocks serializes the fetching of each image verified
+	// against the local keyring
+	imageFetchLocks *keyedMutex
+
+	// starting holds the cancel functions of the tasks being started
+	starting *startingTasks
+
 	// logger will log to the Nomad agent
 	logger hclog.Logger
 }
@@ -134,6 +276,28 @@ type Driver struct {
 // GCConfig is the driver GarbageCollection configuration
 type GCConfig struct {
 	Container bool `codec:"container"`
+
+	// Orphans enables the reaper of containers that follow the driver naming
+	// scheme but aren't referenced by any task. Orphans are stopped and
+	// destroyed once they have been unreferenced for OrphanGracePeriod;
+	// lxc_path is scanned every OrphanInterval.
+	Orphans           bool   `codec:"orphans"`
+	OrphanGracePeriod string `codec:"orphan_grace_period"`
+	OrphanInterval    string `codec:"orphan_interval"`
+
+	// KeepFailed keeps the stopped containers of failed tasks for the given
+	// duration after their task is destroyed, and KeepLast the containers of
+	// the last KeepLast tasks of each job whatever their outcome. The oldest
+	// kept containers are destroyed first once they use more than MaxDiskMB.
+	// Kept containers are renamed so the next run of the task can't collide
+	// with them.
+	KeepFailed string `codec:"keep_failed"`
+	KeepLast   int    `codec:"keep_last"`
+	MaxDiskMB  int    `codec:"max_disk_mb"`
+
+	orphanGracePeriod time.Duration
+	orphanInterval    time.Duration
+	keepFailed        time.Duration
 }
 
 // Config is the driver configuration set by the SetConfig RPC call
@@ -151,6 +315,31 @@ type Config struct {
 	NetworkMode string `codec:"network_mode"`
 
 	GC GCConfig `codec:"gc"`
+
+	ImageCache ImageCacheConfig `codec:"image_cache"`
+
+	Clone CloneConfig `codec:"clone"`
+
+	BackingStore BackingStoreConfig `codec:"backingstore"`
+
+	// Prepull lists the images to download when the driver starts. Images
+	// added by a later config are downloaded then, as are those that failed to
+	// download; removed ones stay cached.
+	Prepull []string `codec:"prepull"`
+
+	// GPGKeyring is the path of a local keyring of trusted image signing
+	// keys. If set, the driver fetches images of the download template and
+	// verifies them against it, so no key server needs to be reachable. The
+	// image index must be signed too, and cached images are fetched again
+	// once their signing key is removed from the keyring.
+	GPGKeyring string `codec:"gpg_keyring"`
+
+	// CreateTimeout bounds the creation and provisioning of the rootfs of
+	// task containers, including image downloads, unless the task overrides
+	// it
+	CreateTimeout string `codec:"create_timeout"`
+
+	createTimeout time.Duration
 }
 
 // TaskConfig is the driver configuration of a task within a job
@@ -174,17 +363,118 @@ type TaskConfig struct {
 	DefaultConfig        string         `codec:"default_config"`
 	Command              []string       `codec:"command"`
 	Environment          []string       `codec:"environment"`
-	Cgroup	             string         `codec:"cgroup"`
+	Cgroup               string         `codec:"cgroup"`
 	PortMap              map[string]int `codec:"portmap"`
+
+	// SignalAllProcesses delivers signals from SignalTask to every process in
+	// the container cgroup instead of only the container init process
+	SignalAllProcesses bool `codec:"signal_all_processes"`
+
+	// RestartMode is either "recreate" or "reuse" and controls what happens
+	// to the container of a previous run when the task restarts within the
+	// same allocation. Containers of reused tasks outlive DestroyTask; with
+	// container gc they are destroyed once their allocation directory is
+	// removed.
+	RestartMode string `codec:"restart_mode"`
+
+	// BootMode is either "command", to run Command through lxc-init, or
+	// "system", to boot the container's own init system
+	BootMode string `codec:"boot_mode"`
+
+	// HaltSignal and StopSignal override lxc.signal.halt and lxc.signal.stop
+	// of system containers
+	HaltSignal string `codec:"halt_signal"`
+	StopSignal string `codec:"stop_signal"`
+
+	// BackingStore is the backing store of the container, one of the
+	// backing stores allowed by the driver config. BackingStoreFSType and
+	// BackingStoreSizeMB set the filesystem of lvm and loop backed containers.
+	BackingStore       string `codec:"backingstore"`
+	BackingStoreFSType string `codec:"backingstore_fstype"`
+	BackingStoreSizeMB int    `codec:"backingstore_size_mb"`
+
+	// OCIImage is the path of an OCI image layout, optionally followed by
+	// ":<tag>", to create the container from with the oci template. A path
+	// whose last component contains ':' must be followed by a tag. Unless
+	// overridden by Command and Environment, the task runs with the
+	// entrypoint, command, environment and working directory of the image.
+	OCIImage string `codec:"oci_image"`
+
+	// Rootfs is the path of a rootfs tarball or directory to create the
+	// container from instead of a template. Tarballs require RootfsChecksum,
+	// "sha256:<hex digest>", are verified against it and unpacked once per
+	// digest.
+	Rootfs         string `codec:"rootfs"`
+	RootfsChecksum string `codec:"rootfs_checksum"`
+
+	// CreateTimeout overrides the create_timeout of the driver config
+	CreateTimeout string `codec:"create_timeout"`
+
+	// Provision copies files into and runs commands in a newly created
+	// container before the task starts
+	Provision ProvisionConfig `codec:"provision"`
+
+	// Ephemeral runs the task in a container whose rootfs is an overlay of
+	// a shared read-only base and a writable layer that is dropped with the
+	// container. EphemeralStorage keeps the writable layer in the task
+	// directory, "task_dir", or in memory, "tmpfs".
+	Ephemeral        bool   `codec:"ephemeral"`
+	EphemeralStorage string `codec:"ephemeral_storage"`
 }
 
 // TaskState is the state which is encoded in the handle returned in
 // StartTask. This information is needed to rebuild the task state and handler
 // during recovery.
+//
+// The handle cannot be updated once StartTask returns, so the handle also
+// writes its state to the task directory as it changes; see
+// taskHandle.saveState.
 type TaskState struct {
 	TaskConfig    *drivers.TaskConfig
 	ContainerName string
 	StartedAt     time.Time
+
+	// NetworkMode and Mounts are the network mode and mount entries the
+	// container was started with
+	NetworkMode string
+	Mounts      []string
+
+	// BackingStore is the backing store of the container rootfs
+	BackingStore string
+
+	// The remaining fields are set once the task has exited. The exit result
+	// is flattened as drivers.ExitResult holds an error, which doesn't
+	// survive encoding.
+	Exited      bool
+	CompletedAt time.Time
+	ExitCode    int
+	ExitSignal  int
+	OOMKilled   bool
+	ExitError   string
+}
+
+// exitResult returns the exit result recorded in the state
+func (s *TaskState) exitResult() *drivers.ExitResult {
+	r := &drivers.ExitResult{
+		ExitCode:  s.ExitCode,
+		Signal:    s.ExitSignal,
+		OOMKilled: s.OOMKilled,
+	}
+	if s.ExitError != "" {
+		r.Err = errors.New(s.ExitError)
+	}
+	return r
+}
+
+// setExitResult records the exit result r in the state
+func (s *TaskState) setExitResult(r *drivers.ExitResult) {
+	s.ExitCode = r.ExitCode
+	s.ExitSignal = r.Signal
+	s.OOMKilled = r.OOMKilled
+	s.ExitError = ""
+	if r.Err != nil {
+		s.ExitError = r.Err.Error()
+	}
 }
 
 // NewLXCDriver returns a new DriverPlugin implementation
@@ -192,12 +482,18 @@ func NewLXCDriver(logger hclog.Logger) drivers.DriverPlugin {
 	ctx, cancel := context.WithCancel(context.Background())
 	logger = logger.Named(pluginName)
 	return &Driver{
-		eventer:        eventer.NewEventer(ctx, logger),
-		config:         &Config{},
-		tasks:          newTaskStore(),
-		ctx:            ctx,
-		signalShutdown: cancel,
-		logger:         logger,
+		eventer:         eventer.NewEventer(ctx, logger),
+		config:          &Config{},
+		tasks:           newTaskStore(),
+		ctx:             ctx,
+		signalShutdown:  cancel,
+		reaper:          newOrphanReaper(),
+		bases:           newKeyedMutex(),
+		rootfsLocks:     newKeyedMutex(),
+		imageFetchLocks: newKeyedMutex(),
+		starting:        newStartingTasks(),
+		prepulled:       newPrepullSet(),
+		logger:          logger,
 	}
 }
 
@@ -217,14 +513,106 @@ func (d *Driver) SetConfig(cfg *base.Config) error {
 		}
 	}
 
+	if err := config.GC.parse(); err != nil {
+		return err
+	}
+	if err := config.Clone.validate(); err != nil {
+		return err
+	}
+	if err := config.BackingStore.validate(); err != nil {
+		return err
+	}
+	prepull, err := parsePrepullImages(config.Prepull)
+	if err != nil {
+		return err
+	}
+	if config.GPGKeyring != "" {
+		if _, err := loadKeyring(config.GPGKeyring); err != nil {
+			return fmt.Errorf("invalid gpg_keyring: %v", err)
+		}
+	}
+	if config.createTimeout, err = parseCreateTimeout(config.CreateTimeout, defaultCreateTimeout); err != nil {
+		return err
+	}
+
+	cache, err := reconfigureImageCache(d.currentImageCache(), config.ImageCache, d.logger)
+	if err != nil {
+		return err
+	}
+
+	d.configLock.Lock()
 	d.config = &config
+	d.imageCache = cache
 	if cfg.AgentConfig != nil {
 		d.nomadConfig = cfg.AgentConfig.Driver
 	}
+	d.configLock.Unlock()
+
+	d.reaperOnce.Do(func() {
+		go d.runReaper()
+	})
+	if config.Enabled {
+		if keys := d.prepulled.add(prepull); len(keys) > 0 {
+			go d.prepullImages(keys)
+		}
+	}
 
 	return nil
 }
 
+// currentConfig returns the driver configuration set by the last SetConfig
+func (d *Driver) currentConfig() *Config {
+	d.configLock.RLock()
+	defer d.configLock.RUnlock()
+	return d.config
+}
+
+// currentImageCache returns the image cache of the driver configuration, or
+// nil if image_cache.dir isn't set
+func (d *Driver) currentImageCache() *imageCache {
+	d.configLock.RLock()
+	defer d.configLock.RUnlock()
+	return d.imageCache
+}
+
+// parse validates the GC config and parses its durations
+func (c *GCConfig) parse() error {
+	var err error
+	if c.orphanGracePeriod, err = parseGCDuration("orphan_grace_period", c.OrphanGracePeriod, defaultOrphanGracePeriod); err != nil {
+		return err
+	}
+	if c.orphanInterval, err = parseGCDuration("orphan_interval", c.OrphanInterval, defaultOrphanInterval); err != nil {
+		return err
+	}
+	if c.orphanInterval <= 0 {
+		return fmt.Errorf("gc.orphan_interval must be positive")
+	}
+	if c.keepFailed, err = parseGCDuration("keep_failed", c.KeepFailed, 0); err != nil {
+		return err
+	}
+	if c.KeepLast < 0 {
+		return fmt.Errorf("gc.keep_last must not be negative")
+	}
+	if c.MaxDiskMB < 0 {
+		return fmt.Errorf("gc.max_disk_mb must not be negative")
+	}
+	return nil
+}
+
+func parseGCDuration(key, value string, def time.Duration) (time.Duration, error) {
+	if value == "" {
+		return def, nil
+	}
+	dur, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid gc.%s %q: %v", key, value, err)
+	}
+	if dur < 0 {
+		return 0, fmt.Errorf("gc.%s must not be negative", key)
+	}
+	return dur, nil
+}
+
 func (d *Driver) Shutdown(ctx context.Context) error {
 	d.signalShutdown()
 	return nil
@@ -267,7 +655,7 @@ func (d *Driver) buildFingerprint() *drivers.Fingerprint {
 
 	lxcVersion := lxc.Version()
 
-	if d.config.Enabled && lxcVersion != "" {
+	if d.currentConfig().Enabled && lxcVersion != "" {
 		health = drivers.HealthStateHealthy
 		desc = "ready"
 		attrs["driver.lxc"] = pstructs.NewBoolAttribute(true)
@@ -277,10 +665,16 @@ func (d *Driver) buildFingerprint() *drivers.Fingerprint {
 		desc = "disabled"
 	}
 
-	if d.config.AllowVolumes {
+	if d.currentConfig().AllowVolumes {
 		attrs["driver.lxc.volumes.enabled"] = pstructs.NewBoolAttribute(true)
 	}
 
+	if health == drivers.HealthStateHealthy {
+		for k, v := range d.imageAttributes() {
+			attrs[k] = v
+		}
+	}
+
 	return &drivers.Fingerprint{
 		Attributes:        attrs,
 		Health:            health,
@@ -307,33 +701,105 @@ func (d *Driver) RecoverTask(handle *drivers.TaskHandle) error {
 	if err := handle.GetDriverState(&taskState); err != nil {
 		return fmt.Errorf("failed to decode task state from handle: %v", err)
 	}
+	if err := d.migrateTaskState(handle.Version, &taskState); err != nil {
+		return fmt.Errorf("failed to migrate task state: %v", err)
+	}
 
 	c, err := lxc.NewContainer(taskState.ContainerName, d.lxcPath())
 	if err != nil {
 		return fmt.Errorf("failed to create container ref: %v", err)
 	}
 
-	initPid := c.InitPid()
+	var driverConfig TaskConfig
+	if err := taskState.TaskConfig.DecodeDriverConfig(&driverConfig); err != nil {
+		return fmt.Errorf("failed to decode driver config: %v", err)
+	}
+
 	h := &taskHandle{
-		container:  c,
-		initPid:    initPid,
-		taskConfig: taskState.TaskConfig,
-		procState:  drivers.TaskStateRunning,
-		startedAt:  taskState.StartedAt,
-		exitResult: &drivers.ExitResult{},
-		logger:     d.logger,
+		container:       c,
+		systemContainer: driverConfig.BootMode == bootModeSystem,
+		taskConfig:      taskState.TaskConfig,
+		networkMode:     taskState.NetworkMode,
+		mounts:          taskState.Mounts,
+		backingStore:    taskState.BackingStore,
+		procState:       drivers.TaskStateRunning,
+		doneCh:          make(chan struct{}),
+		startedAt:       taskState.StartedAt,
+		exitResult:      &drivers.ExitResult{},
+		logger:          d.logger,
+		eventer:         d.eventer,
 
 		totalCpuStats:  stats.NewCpuStats(),
 		userCpuStats:   stats.NewCpuStats(),
 		systemCpuStats: stats.NewCpuStats(),
 	}
 
+	// the task may have exited before the client restarted, in which case
+	// report exactly what was observed at the time
+	savedState, err := loadTaskState(taskState.TaskConfig)
+	if err != nil {
+		d.logger.Warn("failed to load persisted task state", "error", err)
+	}
+	if savedState != nil && savedState.Exited {
+		h.procState = drivers.TaskStateExited
+		h.completedAt = savedState.CompletedAt
+		h.exitResult = savedState.exitResult()
+		close(h.doneCh)
+
+		d.tasks.Set(taskState.TaskConfig.ID, h)
+		return nil
+	}
+
+	// the container may have been stopped or destroyed while the client was
+	// down, in which case the task is reported as exited
+	initPid, err := verifyRecoveredContainer(c, driverConfig, taskState.StartedAt)
+	if err != nil {
+		d.logger.Warn("recovered task is no longer running", "task_id", taskState.TaskConfig.ID, "error", err)
+		d.tasks.Set(taskState.TaskConfig.ID, h)
+		h.markExited(&drivers.ExitResult{Err: err})
+		return nil
+	}
+	h.initPid = initPid
+
+	if h.exitMonitor, err = newExitMonitor(d.lxcPath(), c.Name()); err != nil {
+		d.logger.Warn("failed to monitor container exit status", "error", err)
+	}
+
 	d.tasks.Set(taskState.TaskConfig.ID, h)
 
 	go h.run()
 	return nil
 }
 
+// migrateTaskState upgrades task state decoded from a handle written by an
+// older version of the driver
+func (d *Driver) migrateTaskState(version int, state *TaskState) error {
+	switch version {
+	case taskHandleVersion:
+		return nil
+	case 1:
+		// version 1 only recorded the task config, container name and start
+		// time. Resolve the network mode and mounts from the current driver
+		// config, which is the best that can be done.
+		var driverConfig TaskConfig
+		if err := state.TaskConfig.DecodeDriverConfig(&driverConfig); err != nil {
+			return fmt.Errorf("failed to decode driver config: %v", err)
+		}
+
+		mounts, err := d.mountEntries(state.TaskConfig, driverConfig)
+		if err != nil {
+			d.logger.Warn("failed to resolve mounts of recovered task", "task_id", state.TaskConfig.ID, "error", err)
+		}
+
+		state.NetworkMode = d.networkMode(driverConfig)
+		state.Mounts = mounts
+		state.BackingStore = d.recoveredBackingStore(state.ContainerName)
+		return nil
+	default:
+		return fmt.Errorf("unsupported task handle version %d", version)
+	}
+}
+
 func (d *Driver) StartTask(cfg *drivers.TaskConfig) (*drivers.TaskHandle, *drivers.DriverNetwork, error) {
 	if _, ok := d.tasks.Get(cfg.ID); ok {
 		return nil, nil, fmt.Errorf("task with ID %q already started", cfg.ID)
@@ -349,16 +815,156 @@ func (d *Driver) StartTask(cfg *drivers.TaskConfig) (*drivers.TaskHandle, *drive
 	handle := drivers.NewTaskHandle(taskHandleVersion)
 	handle.Config = cfg
 
-	c, err := d.initializeContainer(cfg, driverConfig)
+	// forget the exit of a previous run of the task in this allocation
+	if err := os.Remove(taskStatePath(cfg)); err != nil && !os.IsNotExist(err) {
+		return nil, nil, fmt.Errorf("failed to remove previous task state: %v", err)
+	}
+
+	mode, err := bootMode(driverConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	createOpts, err := toLXCCreateOptions(driverConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := driverConfig.Provision.validate(); err != nil {
+		return nil, nil, err
+	}
+	if err := d.validateEphemeral(driverConfig); err != nil {
+		return nil, nil, err
+	}
+	backingStore, backend, backendSpecs, err := d.currentConfig().BackingStore.resolve(driverConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	createOpts.Backend = backend
+	createOpts.BackendSpecs = backendSpecs
+
+	var image *ociImage
+	if createOpts.Template == ociTemplate {
+		if image, err = d.ociImage(cfg, driverConfig); err != nil {
+			return nil, nil, err
+		}
+		createOpts.ExtraArgs = append([]string{"--url", image.url()}, createOpts.ExtraArgs...)
+	}
+
+	// creating the rootfs can hang on a template or download; it is bounded
+	// by the create timeout and cancelled if the task is killed meanwhile
+	ctx, createTimeout, cancelCreate, err := d.createContext(cfg, driverConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer cancelCreate()
+
+	name := containerName(cfg)
+	reuse, err := d.prepareContainerName(name, driverConfig)
+	if err != nil {
+		d.logger.Error("failed to prepare container", "error", err)
+		return nil, nil, err
+	}
+
+	cloned := false
+	if !reuse && d.cloneEnabled(driverConfig, createOpts) {
+		d.emitEvent(cfg, createEventMessage(createOpts), nil)
+		phaseStart := time.Now()
+		base, v, err := d.cloneFromBase(ctx, name, createOpts, d.defaultConfig(driverConfig))
+		if v != nil {
+			d.emitEvent(cfg, v.eventMessage(), v.annotations())
+		}
+		if ctx.Err() != nil {
+			return nil, nil, nstructs.NewRecoverableError(createError(ctx, createTimeout, err), true)
+		}
+		if err != nil {
+			d.logger.Warn("failed to clone base container, creating container from template", "error", err)
+		} else {
+			cloned = true
+			d.emitPhaseEvent(cfg, startPhaseCreate, phaseStart, fmt.Sprintf("Cloned container rootfs from %s", base))
+		}
+	}
+
+	c, err := d.initializeContainer(cfg, driverConfig, reuse || cloned)
 	if err != nil {
 		d.logger.Error("failed to initializeContainer", "error", err)
+		if cloned {
+			// the next attempt clones the base container again
+			if err := destroyContainer(name, d.lxcPath()); err != nil {
+				d.logger.Error("failed to destroy cloned container", "container", name, "error", err)
+			}
+		}
 		return nil, nil, err
 	}
 
-	opt := toLXCCreateOptions(driverConfig)
+	if reuse {
+		d.emitEvent(cfg, "Reusing existing container rootfs", nil)
+	} else if driverConfig.Ephemeral {
+		d.emitEvent(cfg, "Preparing ephemeral container rootfs", nil)
+		phaseStart := time.Now()
+		lower, v, err := d.ephemeralLower(ctx, cfg, driverConfig, createOpts)
+		if v != nil {
+			d.emitEvent(cfg, v.eventMessage(), v.annotations())
+		}
+		if ctx.Err() != nil {
+			return nil, nil, nstructs.NewRecoverableError(createError(ctx, createTimeout, err), true)
+		}
+		if err != nil {
+			return nil, nil, nstructs.NewRecoverableError(err, true)
+		}
+		upper, err := d.prepareEphemeralStorage(cfg, driverConfig)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := d.defineOverlayContainer(c, lower, upper); err != nil {
+			d.releaseEphemeralStorage(cfg)
+			return nil, nil, err
+		}
+		d.emitPhaseEvent(cfg, startPhaseCreate, phaseStart, "Created ephemeral container")
+	} else if driverConfig.Rootfs != "" {
+		d.emitEvent(cfg, "Preparing container rootfs", nil)
+		phaseStart := time.Now()
+		lower, cached, err := d.prepareRootfs(ctx, cfg, driverConfig)
+		if err == nil {
+			err = d.defineRootfsContainer(c, lower)
+		}
+		if err != nil {
+			d.destroyPartialContainer(name, err)
+			if ctx.Err() != nil {
+				return nil, nil, nstructs.NewRecoverableError(createError(ctx, createTimeout, err), true)
+			}
+			return nil, nil, err
+		}
+		if cached {
+			d.emitPhaseEvent(cfg, startPhaseCreate, phaseStart, "Created container from cached rootfs")
+		} else {
+			d.emitPhaseEvent(cfg, startPhaseCreate, phaseStart, "Created container from rootfs")
+		}
+	} else if !cloned {
+		opt := createOpts
+
+		// creating the rootfs may include downloading an image, which can
+		// take a while; let the user know it has begun
+		d.emitEvent(cfg, createEventMessage(opt), nil)
+		phaseStart := time.Now()
+		created, err := d.createRootfs(ctx, c, opt)
+		if v := created.verification; v != nil {
+			d.emitEvent(cfg, v.eventMessage(), v.annotations())
+		}
+		if err != nil {
+			d.destroyPartialContainer(name, err)
+			return nil, nil, nstructs.NewRecoverableError(createError(ctx, createTimeout, err), true)
+		}
+		if created.cached {
+			d.emitPhaseEvent(cfg, startPhaseCreate, phaseStart, "Created container rootfs from cached image")
+		} else {
+			d.emitPhaseEvent(cfg, startPhaseCreate, phaseStart, "Created container rootfs")
+		}
+	}
 
-	if err := c.Create(opt); err != nil {
-		return nil, nil, nstructs.NewRecoverableError(err, true)
+	// reused and cloned containers have the backing store they were created
+	// with, whatever the task asks for now
+	if bs := containerBackingStore(c); bs != "" {
+		backingStore = bs
 	}
 
 	cleanup := func() {
@@ -370,38 +976,107 @@ func (d *Driver) StartTask(cfg *drivers.TaskConfig) (*drivers.TaskHandle, *drive
 		if err := c.Destroy(); err != nil {
 			d.logger.Error("failed to Destroy during clean up from an error in Start", "error", err)
 		}
+		if driverConfig.Ephemeral {
+			d.releaseEphemeralStorage(cfg)
+		}
 	}
 
+	// the oci template writes the image environment after the task's
+	if image != nil {
+		if err := applyOCIImageConfig(c, image, taskEnvironment(cfg, driverConfig)); err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+	}
+
+	phaseStart := time.Now()
 	if err := d.configureContainerNetwork(c, driverConfig); err != nil {
 		cleanup()
 		return nil, nil, err
 	}
+	d.emitPhaseEvent(cfg, startPhaseNetwork, phaseStart, "Configured container network")
 
-	if err := d.mountVolumes(c, cfg, driverConfig); err != nil {
+	phaseStart = time.Now()
+	mounts, err := d.mountVolumes(c, cfg, driverConfig)
+	if err != nil {
 		d.logger.Error("failed to mountVolumes", "error", err)
 		cleanup()
 		return nil, nil, err
 	}
+	d.emitPhaseEvent(cfg, startPhaseMounts, phaseStart, "Configured volume mounts")
+
+	// provisioning runs the container, so it must be done before the exit
+	// monitor subscribes to its state
+	if !reuse && !driverConfig.Provision.empty() {
+		d.emitEvent(cfg, "Provisioning container", nil)
+		phaseStart = time.Now()
+		if err := d.provisionContainer(ctx, c, cfg, driverConfig.Provision); err != nil {
+			cleanup()
+			if ctx.Err() != nil {
+				return nil, nil, nstructs.NewRecoverableError(createError(ctx, createTimeout, err), true)
+			}
+			return nil, nil, err
+		}
+		d.emitPhaseEvent(cfg, startPhaseProvision, phaseStart, "Provisioned container")
+	}
 
-	if err := c.StartExecute(driverConfig.Command); err != nil {
+	// subscribe before starting so the exit status cannot be missed
+	exitMon, err := newExitMonitor(d.lxcPath(), c.Name())
+	if err != nil {
+		d.logger.Warn("failed to monitor container exit status", "error", err)
+	}
+	cleanupMonitor := func() {
+		if exitMon != nil {
+			exitMon.close()
+		}
+	}
+
+	phaseStart = time.Now()
+	if mode == bootModeSystem {
+		if err := d.configureSystemContainer(c, cfg, driverConfig); err != nil {
+			cleanupMonitor()
+			cleanup()
+			return nil, nil, err
+		}
+		err = c.Start()
+	} else {
+		command := driverConfig.Command
+		if len(command) == 0 && image != nil {
+			command = image.config.command()
+		}
+		err = c.StartExecute(command)
+	}
+	if err != nil {
+		cleanupMonitor()
 		cleanup()
 		return nil, nil, fmt.Errorf("unable to start container: err %v", err)
 	}
+	d.emitPhaseEvent(cfg, startPhaseStart, phaseStart, "Started container")
 
+	phaseStart = time.Now()
 	if err := d.setResourceLimits(c, cfg); err != nil {
+		cleanupMonitor()
 		cleanup()
 		return nil, nil, err
 	}
+	d.emitPhaseEvent(cfg, startPhaseResources, phaseStart, "Applied resource limits")
 
 	pid := c.InitPid()
 
 	h := &taskHandle{
-		container:  c,
-		initPid:    pid,
-		taskConfig: cfg,
-		procState:  drivers.TaskStateRunning,
-		startedAt:  time.Now().Round(time.Millisecond),
-		logger:     d.logger,
+		container:       c,
+		initPid:         pid,
+		systemContainer: mode == bootModeSystem,
+		networkMode:     d.networkMode(driverConfig),
+		mounts:          mounts,
+		backingStore:    backingStore,
+		exitMonitor:     exitMon,
+		taskConfig:      cfg,
+		procState:       drivers.TaskStateRunning,
+		doneCh:          make(chan struct{}),
+		startedAt:       time.Now().Round(time.Millisecond),
+		logger:          d.logger,
+		eventer:         d.eventer,
 
 		totalCpuStats:  stats.NewCpuStats(),
 		userCpuStats:   stats.NewCpuStats(),
@@ -412,10 +1087,14 @@ func (d *Driver) StartTask(cfg *drivers.TaskConfig) (*drivers.TaskHandle, *drive
 		ContainerName: c.Name(),
 		TaskConfig:    cfg,
 		StartedAt:     h.startedAt,
+		NetworkMode:   h.networkMode,
+		Mounts:        h.mounts,
+		BackingStore:  h.backingStore,
 	}
 
 	if err := handle.SetDriverState(&driverState); err != nil {
 		d.logger.Error("failed to start task, error setting driver state", "error", err)
+		cleanupMonitor()
 		cleanup()
 		return nil, nil, fmt.Errorf("failed to set driver state: %v", err)
 	}
@@ -444,7 +1123,7 @@ func (d *Driver) handleWait(ctx context.Context, handle *taskHandle, ch chan *dr
 	defer close(ch)
 
 	//
-	// Wait for process completion by polling status from handler.
+	// Wait for the handler to mark the task exited.
 	// We cannot use the following alternatives:
 	//   * Process.Wait() requires LXC container processes to be children
 	//     of self process; but LXC runs container in separate PID hierarchy
@@ -452,22 +1131,20 @@ func (d *Driver) handleWait(ctx context.Context, handle *taskHandle, ch chan *dr
 	//   * lxc.Container.Wait() holds a write lock on container and prevents
 	//     any other calls, including stats.
 	//
-	// Going with simplest approach of polling for handler to mark exit.
-	ticker := time.NewTicker(2 * time.Second)
-	defer ticker.Stop()
+	// The handler is notified of the exit by the kernel (see waitForExit)
+	// and closes doneCh once the exit result is known.
+	select {
+	case <-ctx.Done():
+		return
+	case <-d.ctx.Done():
+		return
+	case <-handle.doneCh:
+	}
 
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-d.ctx.Done():
-			return
-		case <-ticker.C:
-			s := handle.TaskStatus()
-			if s.State == drivers.TaskStateExited {
-				ch <- handle.exitResult
-			}
-		}
+	select {
+	case <-ctx.Done():
+	case <-d.ctx.Done():
+	case ch <- handle.TaskStatus().ExitResult:
 	}
 }
 
@@ -475,10 +1152,24 @@ func (d *Driver) StopTask(taskID string, timeout time.Duration, signal string) e
 	d.logger.Info("stop lxc task", "driver_cfg", hclog.Fmt("%+v", taskID))
 	handle, ok := d.tasks.Get(taskID)
 	if !ok {
+		// a task killed while starting stops creating its container
+		if d.starting.cancel(taskID) {
+			d.logger.Info("cancelled creation of container of starting task", "task_id", taskID)
+		}
 		return drivers.ErrTaskNotFound
 	}
 
-	if err := handle.shutdown(timeout); err != nil {
+	// the init system of a system container has its own notion of signals,
+	// so it is always asked to halt with lxc.signal.halt
+	var sig syscall.Signal
+	if signal != "" && !handle.systemContainer {
+		var err error
+		if sig, err = lookupSignal(signal); err != nil {
+			return err
+		}
+	}
+
+	if err := handle.shutdown(sig, timeout); err != nil {
 		d.logger.Info("stop lxc task", "driver_cfg", hclog.Fmt("failed, %+v", err))
 		return fmt.Errorf("executor Shutdown failed: %v", err)
 	}
@@ -490,6 +1181,9 @@ func (d *Driver) DestroyTask(taskID string, force bool) error {
 	d.logger.Info("destory lxc task", "driver_cfg", hclog.Fmt("%+v", taskID))
 	handle, ok := d.tasks.Get(taskID)
 	if !ok {
+		if d.starting.cancel(taskID) {
+			d.logger.Info("cancelled creation of container of starting task", "task_id", taskID)
+		}
 		return drivers.ErrTaskNotFound
 	}
 
@@ -500,19 +1194,56 @@ func (d *Driver) DestroyTask(taskID string, force bool) error {
 
 	if handle.IsRunning() {
 		// grace period is chosen arbitrary here
-		if err := handle.shutdown(1 * time.Minute); err != nil {
+		if err := handle.shutdown(0, 1*time.Minute); err != nil {
 			d.logger.Info("destory lxc task", "driver_cfg", hclog.Fmt("failed to stop %+v", err))
 			handle.logger.Error("failed to destroy executor", "err", err)
 		}
 	}
-	handle.logger.Info("Destroying container", "container", handle.container.Name())
-	// delete the container itself
-	if err := handle.container.Destroy(); err != nil {
-		d.logger.Info("destory lxc task", "driver_cfg", hclog.Fmt("failed to delete %+v", err))
-		handle.logger.Error("failed to destroy lxc container", "err", err)
+
+	var driverConfig TaskConfig
+	if err := handle.taskConfig.DecodeDriverConfig(&driverConfig); err != nil {
+		handle.logger.Warn("failed to decode driver config", "error", err)
+	}
+
+	gc := d.currentConfig().GC
+	exitResult := handle.TaskStatus().ExitResult
+	switch {
+	case driverConfig.Ephemeral:
+		// the writable layer of ephemeral containers never outlives them
+		handle.logger.Info("Destroying ephemeral container", "container", handle.container.Name())
+		if err := handle.container.Destroy(); err != nil {
+			handle.logger.Error("failed to destroy lxc container", "err", err)
+		}
+		d.releaseEphemeralStorage(handle.taskConfig)
+	case driverConfig.RestartMode == restartModeReuse && gc.Container:
+		// keep the container for the next run of the task; the reaper
+		// destroys it once the allocation is gone
+		handle.logger.Info("Keeping container for reuse", "container", handle.container.Name())
+		if err := d.keepForReuse(handle); err != nil {
+			handle.logger.Error("failed to record reused container", "err", err)
+		}
+	case !gc.Container:
+		handle.logger.Info("Keeping container, container gc is disabled", "container", handle.container.Name())
+	case gc.retainPolicy().retains(exitResult):
+		handle.logger.Info("Retaining stopped container", "container", handle.container.Name(), "failed", taskFailed(exitResult))
+		if err := d.retainContainer(handle, exitResult); err != nil {
+			handle.logger.Error("failed to record retained container", "err", err)
+		}
+	default:
+		handle.logger.Info("Destroying container", "container", handle.container.Name())
+		// delete the container itself
+		if err := handle.container.Destroy(); err != nil {
+			d.logger.Info("destory lxc task", "driver_cfg", hclog.Fmt("failed to delete %+v", err))
+			handle.logger.Error("failed to destroy lxc container", "err", err)
+		}
 	}
 	// finally cleanup task map
 	d.tasks.Delete(taskID)
+
+	if gc.Container && gc.retainPolicy().retains(exitResult) && !driverConfig.Ephemeral {
+		// enforce keep_last and max_disk_mb right away
+		go d.reap(gc)
+	}
 	return nil
 }
 
@@ -540,9 +1271,72 @@ func (d *Driver) TaskEvents(ctx context.Context) (<-chan *drivers.TaskEvent, err
 }
 
 func (d *Driver) SignalTask(taskID string, signal string) error {
-	return fmt.Errorf("LXC driver does not support signals")
+	d.logger.Info("signal lxc task", "driver_cfg", hclog.Fmt("%+v", taskID), "signal", signal)
+	handle, ok := d.tasks.Get(taskID)
+	if !ok {
+		return drivers.ErrTaskNotFound
+	}
+
+	sig, err := lookupSignal(signal)
+	if err != nil {
+		return err
+	}
+
+	var driverConfig TaskConfig
+	if err := handle.taskConfig.DecodeDriverConfig(&driverConfig); err != nil {
+		return fmt.Errorf("failed to decode driver config: %v", err)
+	}
+
+	return handle.signal(sig, driverConfig.SignalAllProcesses)
+}
+
+// lookupSignal translates a signal name from a job, such as SIGHUP, into the
+// signal to deliver to the task
+func lookupSignal(name string) (syscall.Signal, error) {
+	s, ok := signals.SignalLookup[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown signal %q", name)
+	}
+	sig, ok := s.(syscall.Signal)
+	if !ok {
+		return 0, fmt.Errorf("signal %q cannot be sent to a process", name)
+	}
+	return sig, nil
 }
 
 func (d *Driver) ExecTask(taskID string, cmd []string, timeout time.Duration) (*drivers.ExecTaskResult, error) {
-	return nil, fmt.Errorf("LXC driver does not support exec")
+	d.logger.Debug("exec lxc task", "driver_cfg", hclog.Fmt("%+v", taskID), "cmd", cmd)
+	handle, ok := d.tasks.Get(taskID)
+	if !ok {
+		return nil, drivers.ErrTaskNotFound
+	}
+
+	return handle.exec(cmd, timeout)
+}
+
+func (d *Driver) ExecTaskStreamingRaw(ctx context.Context, taskID string, command []string, tty bool, stream drivers.ExecTaskStream) error {
+	d.logger.Debug("exec streaming lxc task", "driver_cfg", hclog.Fmt("%+v", taskID), "cmd", command, "tty", tty)
+	handle, ok := d.tasks.Get(taskID)
+	if !ok {
+		return drivers.ErrTaskNotFound
+	}
+
+	execOpts, errCh := drivers.StreamToExecOptions(ctx, command, tty, stream)
+
+	result, err := handle.execStreaming(ctx, execOpts)
+	execOpts.Stdout.Close()
+	execOpts.Stderr.Close()
+	if err != nil {
+		return err
+	}
+
+	select {
+	case err := <-errCh:
+		if err != nil {
+			return err
+		}
+	default:
+	}
+
+	return stream.Send(drivers.NewExecStreamingResponseExit(result.ExitCode))
 }
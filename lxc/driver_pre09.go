@@ -2,6 +2,7 @@ package lxc
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/hashicorp/nomad/client/state"
 	"github.com/hashicorp/nomad/client/stats"
@@ -20,20 +21,35 @@ func (d *Driver) recoverPre09Task(h *drivers.TaskHandle) error {
 		return fmt.Errorf("failed to create container ref: %v", err)
 	}
 
-	initPid := c.InitPid()
+	var driverConfig TaskConfig
+	if err := h.Config.DecodeDriverConfig(&driverConfig); err != nil {
+		return fmt.Errorf("failed to decode driver config: %v", err)
+	}
+
 	th := &taskHandle{
 		container:  c,
-		initPid:    initPid,
 		taskConfig: h.Config,
 		procState:  drivers.TaskStateRunning,
+		doneCh:     make(chan struct{}),
 		exitResult: &drivers.ExitResult{},
 		logger:     d.logger,
+		eventer:    d.eventer,
 
 		totalCpuStats:  stats.NewCpuStats(),
 		userCpuStats:   stats.NewCpuStats(),
 		systemCpuStats: stats.NewCpuStats(),
 	}
 
+	// pre 0.9 handles don't record when the task started
+	initPid, err := verifyRecoveredContainer(c, driverConfig, time.Time{})
+	if err != nil {
+		d.logger.Warn("recovered task is no longer running", "task_id", h.Config.ID, "error", err)
+		d.tasks.Set(h.Config.ID, th)
+		th.markExited(&drivers.ExitResult{Err: err})
+		return nil
+	}
+	th.initPid = initPid
+
 	d.tasks.Set(h.Config.ID, th)
 
 	go th.run()
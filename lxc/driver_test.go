@@ -7,6 +7,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"syscall"
 	"testing"
 	"time"
 
@@ -67,6 +68,56 @@ func TestLXCDriver_FingerprintNotEnabled(t *testing.T) {
 	}
 }
 
+func TestLXCDriver_LookupSignal(t *testing.T) {
+	t.Parallel()
+
+	sig, err := lookupSignal("SIGQUIT")
+	require.NoError(t, err)
+	require.Equal(t, syscall.SIGQUIT, sig)
+
+	_, err = lookupSignal("SIGBOGUS")
+	require.EqualError(t, err, `unknown signal "SIGBOGUS"`)
+}
+
+func TestLXCDriver_TaskStateExitResult(t *testing.T) {
+	t.Parallel()
+
+	var state TaskState
+	state.setExitResult(&drivers.ExitResult{
+		ExitCode:  137,
+		Signal:    9,
+		OOMKilled: true,
+		Err:       fmt.Errorf("container web-1234 no longer exists"),
+	})
+
+	result := state.exitResult()
+	require.Equal(t, 137, result.ExitCode)
+	require.Equal(t, 9, result.Signal)
+	require.True(t, result.OOMKilled)
+	require.EqualError(t, result.Err, "container web-1234 no longer exists")
+}
+
+func TestLXCDriver_MigrateTaskState(t *testing.T) {
+	t.Parallel()
+
+	d := NewLXCDriver(testlog.HCLogger(t)).(*Driver)
+	d.config.NetworkMode = "bridge"
+
+	task := &drivers.TaskConfig{
+		ID:      uuid.Generate(),
+		AllocID: uuid.Generate(),
+		Name:    "test",
+	}
+	require.NoError(t, task.EncodeConcreteDriverConfig(&TaskConfig{Template: "busybox"}))
+
+	state := TaskState{TaskConfig: task, ContainerName: "test"}
+	require.NoError(t, d.migrateTaskState(1, &state))
+	require.Equal(t, "bridge", state.NetworkMode)
+	require.NotEmpty(t, state.Mounts)
+
+	require.EqualError(t, d.migrateTaskState(3, &state), "unsupported task handle version 3")
+}
+
 func TestLXCDriver_Start_Wait(t *testing.T) {
 	if !testutil.IsTravis() {
 		t.Parallel()
@@ -460,3 +511,19 @@ func requireLXC(t *testing.T) {
 		t.Skip("skipping, lxc not present")
 	}
 }
+
+func TestLXCDriver_GCConfigParse(t *testing.T) {
+	t.Parallel()
+
+	gc := GCConfig{Container: true, OrphanGracePeriod: "30m", KeepFailed: "24h", KeepLast: 2}
+	require.NoError(t, gc.parse())
+	require.Equal(t, 30*time.Minute, gc.orphanGracePeriod)
+	require.Equal(t, defaultOrphanInterval, gc.orphanInterval)
+	require.Equal(t, retainPolicy{keepFailed: 24 * time.Hour, keepLast: 2}, gc.retainPolicy())
+
+	gc = GCConfig{KeepFailed: "a day"}
+	require.Error(t, gc.parse())
+
+	gc = GCConfig{KeepLast: -1}
+	require.EqualError(t, gc.parse(), "gc.keep_last must not be negative")
+}
@@ -0,0 +1,136 @@
+package lxc
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+	lxc "github.com/lxc/go-lxc"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// ephemeralStorageTaskDir keeps the writable layer of ephemeral
+	// containers in the task directory
+	ephemeralStorageTaskDir = "task_dir"
+
+	// ephemeralStorageTmpfs keeps the writable layer of ephemeral
+	// containers in memory, up to the memory of the task
+	ephemeralStorageTmpfs = "tmpfs"
+
+	// ephemeralDir is the directory of the task directory holding the
+	// writable layer of an ephemeral container
+	ephemeralDir = "ephemeral"
+
+	// ephemeralBaseBackend names base containers of ephemeral tasks. Their
+	// base is a directory, as that of overlay clones, so both share it.
+	ephemeralBaseBackend = "overlay"
+)
+
+// validateEphemeral checks that the task config can run in an ephemeral
+// container
+func (d *Driver) validateEphemeral(taskConfig TaskConfig) error {
+	if !taskConfig.Ephemeral {
+		if taskConfig.EphemeralStorage != "" {
+			return fmt.Errorf("lxc driver config 'ephemeral_storage' requires 'ephemeral'")
+		}
+		return nil
+	}
+
+	switch taskConfig.EphemeralStorage {
+	case "", ephemeralStorageTaskDir, ephemeralStorageTmpfs:
+	default:
+		return fmt.Errorf("lxc driver config 'ephemeral_storage' can only be either %s or %s", ephemeralStorageTaskDir, ephemeralStorageTmpfs)
+	}
+
+	switch {
+	case taskConfig.RestartMode == restartModeReuse:
+		return fmt.Errorf("lxc driver config 'restart_mode' cannot be reuse when 'ephemeral' is set")
+	case taskConfig.BackingStore != "":
+		return fmt.Errorf("lxc driver config 'backingstore' cannot be set when 'ephemeral' is set")
+	case taskConfig.OCIImage != "":
+		return fmt.Errorf("lxc driver config 'oci_image' cannot be set when 'ephemeral' is set")
+	case taskConfig.FlushCache:
+		return fmt.Errorf("lxc driver config 'flush_cache' cannot be set when 'ephemeral' is set")
+	case !d.currentConfig().BackingStore.allowed("overlay"):
+		return fmt.Errorf("lxc driver config 'ephemeral' requires the overlay backing store, which is not allowed on this node")
+	}
+	return nil
+}
+
+// ephemeralUpperDir returns the directory of the writable layer of the
+// ephemeral container of the task
+func ephemeralUpperDir(cfg *drivers.TaskConfig) string {
+	return filepath.Join(cfg.TaskDir().Dir, ephemeralDir, "delta0")
+}
+
+// ephemeralLower returns the read-only lower layer of the ephemeral container
+// of the task: the unpacked rootfs of the task, or the rootfs of a base
+// container created from the template once and shared by all tasks, with the
+// verification of its image if the base container was created.
+func (d *Driver) ephemeralLower(ctx context.Context, cfg *drivers.TaskConfig, taskConfig TaskConfig, opts lxc.TemplateOptions) (string, *imageVerification, error) {
+	if taskConfig.Rootfs != "" {
+		lower, _, err := d.prepareRootfs(ctx, cfg, taskConfig)
+		return lower, nil, err
+	}
+
+	defaultConfig := d.defaultConfig(taskConfig)
+	name := baseContainerName(opts, defaultConfig, ephemeralBaseBackend)
+
+	unlock := d.bases.lock(name)
+	base, v, err := d.prepareBaseContainer(ctx, name, opts, defaultConfig, lxc.Directory)
+	unlock()
+	if err != nil {
+		return "", v, fmt.Errorf("failed to prepare base container %q: %v", name, err)
+	}
+	defer base.Release()
+
+	lower, err := rootfsHostDir(base.ConfigItem("lxc.rootfs.path"))
+	return lower, v, err
+}
+
+// prepareEphemeralStorage creates the directory of the writable layer of the
+// ephemeral container of the task, on a tmpfs if asked for, and returns the
+// directory for the upper layer of the overlay
+func (d *Driver) prepareEphemeralStorage(cfg *drivers.TaskConfig, taskConfig TaskConfig) (string, error) {
+	// a previous run of the task may have left its layer behind
+	d.releaseEphemeralStorage(cfg)
+
+	dir := filepath.Join(cfg.TaskDir().Dir, ephemeralDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("failed to create ephemeral storage: %v", err)
+	}
+
+	if taskConfig.EphemeralStorage == ephemeralStorageTmpfs {
+		data := "mode=0700"
+		if cfg.Resources != nil && cfg.Resources.NomadResources != nil {
+			if mb := cfg.Resources.NomadResources.Memory.MemoryMB; mb > 0 {
+				data = fmt.Sprintf("%s,size=%dm", data, mb)
+			}
+		}
+		if err := unix.Mount("tmpfs", dir, "tmpfs", 0, data); err != nil {
+			return "", fmt.Errorf("failed to mount tmpfs for ephemeral storage: %v", err)
+		}
+	}
+
+	return ephemeralUpperDir(cfg), nil
+}
+
+// releaseEphemeralStorage drops the writable layer of the ephemeral container
+// of the task
+func (d *Driver) releaseEphemeralStorage(cfg *drivers.TaskConfig) {
+	dir := filepath.Join(cfg.TaskDir().Dir, ephemeralDir)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return
+	}
+
+	// the directory is only a mount point with tmpfs storage
+	if err := unix.Unmount(dir, unix.MNT_DETACH); err != nil && err != unix.EINVAL {
+		d.logger.Warn("failed to unmount ephemeral storage", "path", dir, "error", err)
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		d.logger.Warn("failed to remove ephemeral storage", "path", dir, "error", err)
+	}
+}
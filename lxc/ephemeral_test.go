@@ -0,0 +1,65 @@
+package lxc
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/nomad/helper/testlog"
+	"github.com/hashicorp/nomad/helper/uuid"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLXCDriver_ValidateEphemeral(t *testing.T) {
+	t.Parallel()
+
+	d := NewLXCDriver(testlog.HCLogger(t)).(*Driver)
+
+	require.NoError(t, d.validateEphemeral(TaskConfig{}))
+	require.NoError(t, d.validateEphemeral(TaskConfig{Ephemeral: true}))
+	require.NoError(t, d.validateEphemeral(TaskConfig{Ephemeral: true, EphemeralStorage: "tmpfs"}))
+	require.NoError(t, d.validateEphemeral(TaskConfig{Ephemeral: true, Rootfs: "local/rootfs.tar"}))
+
+	require.EqualError(t, d.validateEphemeral(TaskConfig{EphemeralStorage: "tmpfs"}),
+		"lxc driver config 'ephemeral_storage' requires 'ephemeral'")
+	require.EqualError(t, d.validateEphemeral(TaskConfig{Ephemeral: true, EphemeralStorage: "disk"}),
+		"lxc driver config 'ephemeral_storage' can only be either task_dir or tmpfs")
+	require.EqualError(t, d.validateEphemeral(TaskConfig{Ephemeral: true, RestartMode: restartModeReuse}),
+		"lxc driver config 'restart_mode' cannot be reuse when 'ephemeral' is set")
+	require.EqualError(t, d.validateEphemeral(TaskConfig{Ephemeral: true, BackingStore: "btrfs"}),
+		"lxc driver config 'backingstore' cannot be set when 'ephemeral' is set")
+	require.EqualError(t, d.validateEphemeral(TaskConfig{Ephemeral: true, OCIImage: "local/image"}),
+		"lxc driver config 'oci_image' cannot be set when 'ephemeral' is set")
+
+	d.config.BackingStore = BackingStoreConfig{Default: "dir", Allowed: []string{"dir"}}
+	require.EqualError(t, d.validateEphemeral(TaskConfig{Ephemeral: true}),
+		"lxc driver config 'ephemeral' requires the overlay backing store, which is not allowed on this node")
+}
+
+func TestLXCDriver_EphemeralStorage(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "lxc-ephemeral")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	d := NewLXCDriver(testlog.HCLogger(t)).(*Driver)
+	task := &drivers.TaskConfig{ID: uuid.Generate(), Name: "test", AllocDir: dir}
+	require.NoError(t, os.MkdirAll(task.TaskDir().Dir, 0755))
+
+	// the layer of a previous run is dropped
+	stale := filepath.Join(task.TaskDir().Dir, ephemeralDir, "delta0", "stale")
+	require.NoError(t, os.MkdirAll(filepath.Dir(stale), 0755))
+	require.NoError(t, ioutil.WriteFile(stale, nil, 0644))
+
+	upper, err := d.prepareEphemeralStorage(task, TaskConfig{Ephemeral: true})
+	require.NoError(t, err)
+	require.Equal(t, ephemeralUpperDir(task), upper)
+	require.NoFileExists(t, stale)
+	require.DirExists(t, filepath.Join(task.TaskDir().Dir, ephemeralDir))
+
+	d.releaseEphemeralStorage(task)
+	require.NoDirExists(t, filepath.Join(task.TaskDir().Dir, ephemeralDir))
+}
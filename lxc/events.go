@@ -0,0 +1,70 @@
+package lxc
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/drivers/shared/eventer"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	lxc "github.com/lxc/go-lxc"
+)
+
+const (
+	// startPhase* name the phases of StartTask reported as task events
+	startPhaseCreate    = "create"
+	startPhaseNetwork   = "network"
+	startPhaseMounts    = "mounts"
+	startPhaseProvision = "provision"
+	startPhaseStart     = "start"
+	startPhaseResources = "resources"
+)
+
+// emitTaskEvent sends a task event for the task through e
+func emitTaskEvent(e *eventer.Eventer, logger hclog.Logger, cfg *drivers.TaskConfig, message string, annotations map[string]string) {
+	if e == nil {
+		return
+	}
+
+	err := e.EmitEvent(&drivers.TaskEvent{
+		TaskID:      cfg.ID,
+		AllocID:     cfg.AllocID,
+		TaskName:    cfg.Name,
+		Timestamp:   time.Now(),
+		Message:     message,
+		Annotations: annotations,
+	})
+	if err != nil {
+		logger.Warn("failed to emit task event", "message", message, "error", err)
+	}
+}
+
+// emitEvent sends a task event for a task that may not have a handle yet
+func (d *Driver) emitEvent(cfg *drivers.TaskConfig, message string, annotations map[string]string) {
+	emitTaskEvent(d.eventer, d.logger, cfg, message, annotations)
+}
+
+// emitPhaseEvent reports that a phase of starting the task, begun at start,
+// has completed. The event carries the phase name and its duration so slow
+// starts can be diagnosed from the task events.
+func (d *Driver) emitPhaseEvent(cfg *drivers.TaskConfig, phase string, start time.Time, message string) {
+	elapsed := time.Since(start)
+	d.logger.Debug("task start phase completed", "task_id", cfg.ID, "phase", phase, "duration", elapsed)
+
+	d.emitEvent(cfg, fmt.Sprintf("%s in %s", message, elapsed.Round(time.Millisecond)), map[string]string{
+		"phase":       phase,
+		"duration_ms": strconv.FormatInt(int64(elapsed/time.Millisecond), 10),
+	})
+}
+
+// createEventMessage describes the container creation about to happen
+func createEventMessage(opt lxc.TemplateOptions) string {
+	if opt.Template == ociTemplate {
+		return "Unpacking OCI image and creating container rootfs"
+	}
+	if opt.Distro != "" {
+		return fmt.Sprintf("Fetching image %s/%s/%s and creating container rootfs", opt.Distro, opt.Release, opt.Arch)
+	}
+	return fmt.Sprintf("Creating container rootfs from template %s", opt.Template)
+}
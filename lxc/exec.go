@@ -0,0 +1,394 @@
+package lxc
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/creack/pty"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	lxc "github.com/lxc/go-lxc"
+)
+
+const (
+	// defaultExecPath is the PATH for commands executed in the container if
+	// the task environment doesn't set one
+	defaultExecPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+	// defaultExecTerm is the TERM for interactive commands if the task
+	// environment doesn't set one
+	defaultExecTerm = "xterm"
+
+	// execOutputGrace is how long the output of a streamed command is still
+	// copied once it exited. Processes it left in the background may hold
+	// its terminal or pipes open indefinitely.
+	execOutputGrace = 2 * time.Second
+
+	// execTtyShell makes the terminal on its stdin the controlling terminal
+	// of the command in its arguments. liblxc attaches the command in the
+	// session of the plugin, where the terminal can't become controlling, so
+	// job control and ^C wouldn't work without a new session. setsid may be
+	// missing from minimal images, in which case the command runs as is.
+	execTtyShell = `command -v setsid >/dev/null 2>&1 && exec setsid -c "$@"; exec "$@"`
+)
+
+// execEnv returns the environment for commands attached to the container. The
+// environment of the plugin itself must not leak into the container, so this
+// is built from the task environment only.
+func execEnv(cfg *drivers.TaskConfig) []string {
+	env := make([]string, 0, len(cfg.Env)+1)
+	hasPath := false
+	for k, v := range cfg.Env {
+		if k == "PATH" {
+			hasPath = true
+		}
+		env = append(env, fmt.Sprintf("%s=%s", k, v))
+	}
+	if !hasPath {
+		env = append(env, "PATH="+defaultExecPath)
+	}
+
+	sort.Strings(env)
+	return env
+}
+
+// execAttachOptions returns the liblxc attach options to run a command in the
+// task container with the given stdio file descriptors
+func (h *taskHandle) execAttachOptions(stdin, stdout, stderr *os.File) lxc.AttachOptions {
+	opts := lxc.DefaultAttachOptions
+	opts.ClearEnv = true
+	opts.Env = execEnv(h.taskConfig)
+	opts.Cwd = "/"
+	opts.StdinFd = stdin.Fd()
+	opts.StdoutFd = stdout.Fd()
+	opts.StderrFd = stderr.Fd()
+	return opts
+}
+
+// exec runs cmd inside the running container and returns its output and exit
+// status. The command is killed if it runs longer than timeout.
+func (h *taskHandle) exec(cmd []string, timeout time.Duration) (*drivers.ExecTaskResult, error) {
+	if len(cmd) == 0 {
+		return nil, fmt.Errorf("command is required")
+	}
+	if !h.IsRunning() {
+		return nil, fmt.Errorf("task is not running")
+	}
+
+	stdin, err := os.Open(os.DevNull)
+	if err != nil {
+		return nil, err
+	}
+	defer stdin.Close()
+
+	stdoutR, stdoutW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer stdoutR.Close()
+
+	stderrR, stderrW, err := os.Pipe()
+	if err != nil {
+		stdoutW.Close()
+		return nil, err
+	}
+	defer stderrR.Close()
+
+	// the attached process is a child of this process; see lxc_attach
+	pid, err := h.container.RunCommandNoWait(cmd, h.execAttachOptions(stdin, stdoutW, stderrW))
+
+	// the child holds its own copies of the write ends
+	stdoutW.Close()
+	stderrW.Close()
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to attach to container: %v", err)
+	}
+
+	status, stdout, stderr, err := collectAttached(pid, stdoutR, stderrR, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	exitCode, signal := exitCodeFromStatus(status)
+	return &drivers.ExecTaskResult{
+		Stdout: stdout,
+		Stderr: stderr,
+		ExitResult: &drivers.ExitResult{
+			ExitCode: exitCode,
+			Signal:   signal,
+		},
+	}, nil
+}
+
+// collectAttached waits for an attached process to exit and returns its exit
+// status and what it wrote to the read ends of its stdout and stderr pipes.
+// The process is killed if it runs longer than timeout. Processes it left
+// behind may still hold the pipes open, so the output is only read until the
+// timeout elapses, after which the read ends are closed. A zero timeout waits
+// indefinitely.
+func collectAttached(pid int, stdoutR, stderrR *os.File, timeout time.Duration) (syscall.WaitStatus, []byte, []byte, error) {
+	deadline := time.Now().Add(timeout)
+
+	var stdout, stderr bytes.Buffer
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(&stdout, stdoutR)
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(&stderr, stderrR)
+	}()
+
+	readersDone := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(readersDone)
+	}()
+
+	status, err := waitAttached(pid, timeout)
+	if err != nil {
+		stdoutR.Close()
+		stderrR.Close()
+		<-readersDone
+		return 0, nil, nil, err
+	}
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case <-readersDone:
+	case <-expired:
+		// closing the read ends interrupts the pending reads
+		stdoutR.Close()
+		stderrR.Close()
+		<-readersDone
+	}
+	return status, stdout.Bytes(), stderr.Bytes(), nil
+}
+
+// waitAttached waits for an attached process to exit, killing it if timeout
+// elapses first. A zero timeout waits indefinitely.
+func waitAttached(pid int, timeout time.Duration) (syscall.WaitStatus, error) {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return 0, err
+	}
+
+	if timeout > 0 {
+		timer := time.AfterFunc(timeout, func() {
+			p.Kill()
+		})
+		defer timer.Stop()
+	}
+
+	state, err := p.Wait()
+	if err != nil {
+		return 0, fmt.Errorf("failed to wait for command: %v", err)
+	}
+	return state.Sys().(syscall.WaitStatus), nil
+}
+
+// execStreaming runs an interactive command inside the running container,
+// wiring its stdio to opts until the command exits or ctx is cancelled.
+func (h *taskHandle) execStreaming(ctx context.Context, opts *drivers.ExecOptions) (*drivers.ExitResult, error) {
+	if len(opts.Command) == 0 {
+		return nil, fmt.Errorf("command is required")
+	}
+	if !h.IsRunning() {
+		return nil, fmt.Errorf("task is not running")
+	}
+
+	if opts.Tty {
+		return h.execStreamingTty(ctx, opts)
+	}
+	return h.execStreamingPipes(ctx, opts)
+}
+
+// execStreamingTty runs the command on a new pty; stdout and stderr are both
+// written to opts.Stdout, as with any terminal.
+func (h *taskHandle) execStreamingTty(ctx context.Context, opts *drivers.ExecOptions) (*drivers.ExitResult, error) {
+	master, tty, err := pty.Open()
+	if err != nil {
+		return nil, fmt.Errorf("failed to allocate pty: %v", err)
+	}
+	defer master.Close()
+
+	attachOpts := h.execAttachOptions(tty, tty, tty)
+	if _, ok := h.taskConfig.Env["TERM"]; !ok {
+		attachOpts.Env = append(attachOpts.Env, "TERM="+defaultExecTerm)
+	}
+
+	pid, err := h.container.RunCommandNoWait(execTtyCommand(opts.Command, h.container.InitPid()), attachOpts)
+	tty.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to attach to container: %v", err)
+	}
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case size, ok := <-opts.ResizeCh:
+				if !ok {
+					return
+				}
+				ws := &pty.Winsize{Rows: uint16(size.Height), Cols: uint16(size.Width)}
+				if err := pty.Setsize(master, ws); err != nil {
+					h.logger.Warn("failed to resize exec terminal", "error", err)
+				}
+			}
+		}
+	}()
+
+	go io.Copy(master, opts.Stdin)
+
+	outDone := make(chan struct{})
+	go func() {
+		defer close(outDone)
+		// reading the pty fails with EIO once the command closed the terminal
+		io.Copy(opts.Stdout, master)
+	}()
+
+	status, err := waitAttachedContext(ctx, pid)
+	drainOutput(ctx, outDone, master)
+	if err != nil {
+		return nil, err
+	}
+
+	exitCode, signal := exitCodeFromStatus(status)
+	return &drivers.ExitResult{ExitCode: exitCode, Signal: signal}, nil
+}
+
+// execTtyCommand wraps cmd in execTtyShell if the container of initPid has a
+// shell to run it. The shell is looked up through the root of the init
+// process, as the rootfs may not be mounted on the host.
+func execTtyCommand(cmd []string, initPid int) []string {
+	if initPid <= 0 {
+		return cmd
+	}
+	if _, err := os.Lstat(fmt.Sprintf("/proc/%d/root/bin/sh", initPid)); err != nil {
+		return cmd
+	}
+	return append([]string{"/bin/sh", "-c", execTtyShell, "sh"}, cmd...)
+}
+
+// execStreamingPipes runs the command with stdio connected through pipes
+func (h *taskHandle) execStreamingPipes(ctx context.Context, opts *drivers.ExecOptions) (*drivers.ExitResult, error) {
+	stdinR, stdinW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer stdinW.Close()
+
+	stdoutR, stdoutW, err := os.Pipe()
+	if err != nil {
+		stdinR.Close()
+		return nil, err
+	}
+	defer stdoutR.Close()
+
+	stderrR, stderrW, err := os.Pipe()
+	if err != nil {
+		stdinR.Close()
+		stdoutW.Close()
+		return nil, err
+	}
+	defer stderrR.Close()
+
+	pid, err := h.container.RunCommandNoWait(opts.Command, h.execAttachOptions(stdinR, stdoutW, stderrW))
+	stdinR.Close()
+	stdoutW.Close()
+	stderrW.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to attach to container: %v", err)
+	}
+
+	go func() {
+		io.Copy(stdinW, opts.Stdin)
+		stdinW.Close()
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(opts.Stdout, stdoutR)
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(opts.Stderr, stderrR)
+	}()
+
+	outDone := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(outDone)
+	}()
+
+	status, err := waitAttachedContext(ctx, pid)
+	drainOutput(ctx, outDone, stdoutR, stderrR)
+	if err != nil {
+		return nil, err
+	}
+
+	exitCode, signal := exitCodeFromStatus(status)
+	return &drivers.ExitResult{ExitCode: exitCode, Signal: signal}, nil
+}
+
+// drainOutput waits for the output of an exited command to be copied, which
+// done signals, for at most execOutputGrace or until ctx is done. The read
+// ends are then closed, which interrupts the pending copies.
+func drainOutput(ctx context.Context, done <-chan struct{}, readers ...*os.File) {
+	timer := time.NewTimer(execOutputGrace)
+	defer timer.Stop()
+
+	select {
+	case <-done:
+		return
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	for _, r := range readers {
+		r.Close()
+	}
+	<-done
+}
+
+// waitAttachedContext waits for an attached process to exit, killing it if
+// ctx is cancelled first
+func waitAttachedContext(ctx context.Context, pid int) (syscall.WaitStatus, error) {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return 0, err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			p.Kill()
+		case <-done:
+		}
+	}()
+
+	state, err := p.Wait()
+	if err != nil {
+		return 0, fmt.Errorf("failed to wait for command: %v", err)
+	}
+	return state.Sys().(syscall.WaitStatus), nil
+}
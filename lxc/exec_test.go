@@ -0,0 +1,316 @@
+package lxc
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/creack/pty"
+	ctestutil "github.com/hashicorp/nomad/client/testutil"
+	"github.com/hashicorp/nomad/helper/testlog"
+	"github.com/hashicorp/nomad/helper/uuid"
+	"github.com/hashicorp/nomad/nomad/structs"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	dtestutil "github.com/hashicorp/nomad/plugins/drivers/testutils"
+	"github.com/hashicorp/nomad/testutil"
+	lxc "github.com/lxc/go-lxc"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLXCDriver_ExecEnv(t *testing.T) {
+	t.Parallel()
+
+	env := execEnv(&drivers.TaskConfig{
+		Env: map[string]string{"NOMAD_TASK_NAME": "web", "FOO": "bar"},
+	})
+	require.Equal(t, []string{"FOO=bar", "NOMAD_TASK_NAME=web", "PATH=" + defaultExecPath}, env)
+
+	env = execEnv(&drivers.TaskConfig{
+		Env: map[string]string{"PATH": "/bin"},
+	})
+	require.Equal(t, []string{"PATH=/bin"}, env)
+}
+
+// startPiped starts a host process with stdout and stderr connected to pipes,
+// as liblxc does for attached processes, and returns its pid and the read
+// ends of the pipes
+func startPiped(t *testing.T, args ...string) (int, *os.File, *os.File) {
+	stdoutR, stdoutW, err := os.Pipe()
+	require.NoError(t, err)
+	stderrR, stderrW, err := os.Pipe()
+	require.NoError(t, err)
+
+	p, err := os.StartProcess(args[0], args, &os.ProcAttr{
+		Files: []*os.File{nil, stdoutW, stderrW},
+	})
+	require.NoError(t, err)
+	stdoutW.Close()
+	stderrW.Close()
+	return p.Pid, stdoutR, stderrR
+}
+
+func TestLXCDriver_CollectAttached(t *testing.T) {
+	t.Parallel()
+
+	pid, stdoutR, stderrR := startPiped(t, "/bin/sh", "-c", "echo out; echo err >&2; exit 3")
+	defer stdoutR.Close()
+	defer stderrR.Close()
+
+	status, stdout, stderr, err := collectAttached(pid, stdoutR, stderrR, 10*time.Second)
+	require.NoError(t, err)
+	require.Equal(t, 3, status.ExitStatus())
+	require.Equal(t, "out\n", string(stdout))
+	require.Equal(t, "err\n", string(stderr))
+}
+
+func TestLXCDriver_CollectAttachedBackgroundChild(t *testing.T) {
+	t.Parallel()
+
+	// the background child keeps the pipes open after the command exits
+	pid, stdoutR, stderrR := startPiped(t, "/bin/sh", "-c", "echo started; sleep 60 &")
+	defer stdoutR.Close()
+	defer stderrR.Close()
+
+	start := time.Now()
+	status, stdout, _, err := collectAttached(pid, stdoutR, stderrR, time.Second)
+	require.NoError(t, err)
+	require.Less(t, int64(time.Since(start)), int64(10*time.Second))
+	require.Equal(t, 0, status.ExitStatus())
+	require.Equal(t, "started\n", string(stdout))
+}
+
+func TestLXCDriver_CollectAttachedTimeout(t *testing.T) {
+	t.Parallel()
+
+	pid, stdoutR, stderrR := startPiped(t, "/bin/sh", "-c", "sleep 60 & sleep 60")
+	defer stdoutR.Close()
+	defer stderrR.Close()
+
+	start := time.Now()
+	status, _, _, err := collectAttached(pid, stdoutR, stderrR, time.Second)
+	require.NoError(t, err)
+	require.Less(t, int64(time.Since(start)), int64(10*time.Second))
+	require.True(t, status.Signaled())
+}
+
+func TestLXCDriver_DrainOutput(t *testing.T) {
+	t.Parallel()
+
+	// the background child keeps the pipes open after the command exits
+	pid, stdoutR, stderrR := startPiped(t, "/bin/sh", "-c", "echo started; sleep 60 &")
+	defer stderrR.Close()
+
+	var stdout bytes.Buffer
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		io.Copy(&stdout, stdoutR)
+	}()
+
+	_, err := waitAttachedContext(context.Background(), pid)
+	require.NoError(t, err)
+
+	start := time.Now()
+	drainOutput(context.Background(), done, stdoutR)
+	require.Less(t, int64(time.Since(start)), int64(execOutputGrace+5*time.Second))
+	require.Equal(t, "started\n", stdout.String())
+
+	// a cancelled exec doesn't wait for the grace period
+	pid, stdoutR, stderrR = startPiped(t, "/bin/sh", "-c", "sleep 60 &")
+	defer stderrR.Close()
+	done = make(chan struct{})
+	go func() {
+		defer close(done)
+		io.Copy(ioutil.Discard, stdoutR)
+	}()
+	_, err = waitAttachedContext(context.Background(), pid)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start = time.Now()
+	drainOutput(ctx, done, stdoutR)
+	require.Less(t, int64(time.Since(start)), int64(execOutputGrace))
+}
+
+func TestLXCDriver_ExecTtyCommand(t *testing.T) {
+	t.Parallel()
+
+	cmd := []string{"/bin/sh", "-c", "exec 3</dev/tty && echo ctty; exit 3"}
+	require.Equal(t, cmd, execTtyCommand(cmd, 0))
+
+	// the root of this process is the host, which has a shell
+	wrapped := execTtyCommand(cmd, os.Getpid())
+	require.Equal(t, []string{"/bin/sh", "-c", execTtyShell, "sh"}, wrapped[:4])
+	require.Equal(t, cmd, wrapped[4:])
+
+	if _, err := exec.LookPath("setsid"); err != nil {
+		t.Skip("skipping, setsid not present")
+	}
+
+	// started in the session of the test, like liblxc attaches commands, the
+	// command can only open /dev/tty if the pty became its terminal
+	master, tty, err := pty.Open()
+	require.NoError(t, err)
+	defer master.Close()
+
+	p, err := os.StartProcess(wrapped[0], wrapped, &os.ProcAttr{
+		Files: []*os.File{tty, tty, tty},
+	})
+	require.NoError(t, err)
+	tty.Close()
+
+	state, err := p.Wait()
+	require.NoError(t, err)
+	require.Equal(t, 3, state.ExitCode())
+
+	out, _ := ioutil.ReadAll(master)
+	require.Equal(t, "ctty\r\n", string(out))
+}
+
+type execTestWriter struct {
+	bytes.Buffer
+}
+
+func (*execTestWriter) Close() error {
+	return nil
+}
+
+func TestLXCDriver_ExecStreaming(t *testing.T) {
+	if !testutil.IsTravis() {
+		t.Parallel()
+	}
+	requireLXC(t)
+	ctestutil.RequireRoot(t)
+
+	d := NewLXCDriver(testlog.HCLogger(t)).(*Driver)
+	d.config.Enabled = true
+	d.config.NetworkMode = "host"
+
+	harness := dtestutil.NewDriverHarness(t, d)
+	task := &drivers.TaskConfig{
+		ID:      uuid.Generate(),
+		AllocID: uuid.Generate(),
+		Name:    "test",
+		Resources: &drivers.Resources{
+			NomadResources: &structs.AllocatedTaskResources{
+				Memory: structs.AllocatedMemoryResources{
+					MemoryMB: 2,
+				},
+				Cpu: structs.AllocatedCpuResources{
+					CpuShares: 1024,
+				},
+			},
+			LinuxResources: &drivers.LinuxResources{
+				CPUShares:        1024,
+				MemoryLimitBytes: 2 * 1024,
+			},
+		},
+	}
+	taskConfig := map[string]interface{}{
+		"template": "/usr/share/lxc/templates/lxc-busybox",
+	}
+	require.NoError(t, task.EncodeConcreteDriverConfig(&taskConfig))
+
+	cleanup := harness.MkAllocDir(task, false)
+	defer cleanup()
+
+	_, _, err := harness.StartTask(task)
+	require.NoError(t, err)
+	defer d.DestroyTask(task.ID, true)
+
+	h, ok := d.tasks.Get(task.ID)
+	require.True(t, ok)
+
+	testutil.WaitForResult(func() (bool, error) {
+		if state := h.container.State(); state != lxc.RUNNING {
+			return false, fmt.Errorf("container in state: %v", state)
+		}
+		return true, nil
+	}, func(err error) {
+		t.Fatalf("container failed to start: %v", err)
+	})
+
+	cases := []struct {
+		name     string
+		tty      bool
+		command  []string
+		stdin    string
+		stdout   string
+		stderr   string
+		exitCode int
+	}{
+		{
+			name:    "pipes stdin until eof",
+			command: []string{"cat"},
+			stdin:   "hello\nworld\n",
+			stdout:  "hello\nworld\n",
+		},
+		{
+			name:     "pipes exit code and stderr",
+			command:  []string{"/bin/sh", "-c", "echo out; echo err >&2; exit 7"},
+			stdout:   "out\n",
+			stderr:   "err\n",
+			exitCode: 7,
+		},
+		{
+			name:     "tty is the controlling terminal",
+			tty:      true,
+			command:  []string{"/bin/sh", "-c", "exec 3</dev/tty && echo ctty; echo err >&2; exit 5"},
+			stdout:   "ctty\r\nerr\r\n",
+			exitCode: 5,
+		},
+		{
+			name:    "pipes with a background child",
+			command: []string{"/bin/sh", "-c", "sleep 1000 & echo started"},
+			stdout:  "started\n",
+		},
+		{
+			name:    "tty with a background child",
+			tty:     true,
+			command: []string{"/bin/sh", "-c", "sleep 1000 & echo started"},
+			stdout:  "started\r\n",
+		},
+		{
+			// a terminal reads ^D as the end of the input
+			name:    "tty stdin until eof",
+			tty:     true,
+			command: []string{"/bin/sh", "-c", "cat; echo eof"},
+			stdin:   "hello\n\x04",
+			stdout:  "eof\r\n",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+
+			stdout, stderr := &execTestWriter{}, &execTestWriter{}
+			res, err := h.execStreaming(ctx, &drivers.ExecOptions{
+				Command:  c.command,
+				Tty:      c.tty,
+				Stdin:    ioutil.NopCloser(strings.NewReader(c.stdin)),
+				Stdout:   stdout,
+				Stderr:   stderr,
+				ResizeCh: make(chan drivers.TerminalSize),
+			})
+			require.NoError(t, err)
+			require.Equal(t, c.exitCode, res.ExitCode)
+			require.Equal(t, c.stderr, stderr.String())
+			if c.tty {
+				// the terminal echoes the input
+				require.Contains(t, stdout.String(), c.stdout)
+			} else {
+				require.Equal(t, c.stdout, stdout.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package lxc
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	lxc "github.com/lxc/go-lxc"
+	"golang.org/x/sys/unix"
+)
+
+// waitForExit blocks until the container init process exits. Exit is detected
+// through, in order of preference:
+//
+//   - a pidfd for the init process, on kernels 5.3 and later. A pidfd refers
+//     to the process itself, so it cannot be fooled by the pid being reused.
+//   - the populated key of the container's cgroup.events on cgroup v2, which
+//     the kernel notifies via inotify once the cgroup has no processes left.
+//   - the lxc monitor, which reports the exit status of the init process.
+//   - polling the init pid, as a last resort.
+func waitForExit(c *lxc.Container, pid int, mon *exitMonitor, logger hclog.Logger) error {
+	err := waitPidfd(pid, c)
+	if err == nil {
+		return nil
+	}
+	logger.Debug("pidfd exit notification unavailable", "error", err)
+
+	err = waitCgroupEmpty(pid)
+	if err == nil {
+		return nil
+	}
+	logger.Debug("cgroup exit notification unavailable", "error", err)
+
+	if mon != nil {
+		<-mon.done
+		return nil
+	}
+
+	logger.Warn("no exit notification mechanism available, polling container init process")
+	if ok, err := waitTillStopped(c); !ok {
+		return err
+	}
+	return nil
+}
+
+// waitPidfd waits for pid to exit using a pidfd
+func waitPidfd(pid int, c *lxc.Container) error {
+	fd, err := unix.PidfdOpen(pid, 0)
+	if err == unix.ESRCH {
+		// already gone
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to open pidfd: %v", err)
+	}
+	defer unix.Close(fd)
+
+	// make sure the pidfd refers to the container init and not a process that
+	// reused its pid between looking it up and opening the pidfd
+	if c.InitPid() != pid {
+		return nil
+	}
+
+	// a pidfd becomes readable once the process exits
+	fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+	for {
+		_, err := unix.Poll(fds, -1)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to poll pidfd: %v", err)
+		}
+		return nil
+	}
+}
+
+// waitCgroupEmpty waits for the cgroup v2 cgroup of pid to have no processes
+func waitCgroupEmpty(pid int) error {
+	dir, err := procUnifiedCgroupPath(pid)
+	if err != nil {
+		return err
+	}
+	eventsFile := filepath.Join(dir, "cgroup.events")
+
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC)
+	if err != nil {
+		return fmt.Errorf("failed to initialize inotify: %v", err)
+	}
+	defer unix.Close(fd)
+
+	if _, err := unix.InotifyAddWatch(fd, eventsFile, unix.IN_MODIFY|unix.IN_DELETE_SELF); err != nil {
+		return fmt.Errorf("failed to watch %s: %v", eventsFile, err)
+	}
+
+	buf := make([]byte, unix.SizeofInotifyEvent+unix.NAME_MAX+1)
+	for {
+		// check after the watch is in place so no transition is missed
+		if !cgroupPopulated(eventsFile) {
+			return nil
+		}
+
+		_, err := unix.Read(fd, buf)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read inotify events: %v", err)
+		}
+	}
+}
+
+// cgroupPopulated reports whether the cgroup owning cgroup.events at path still
+// has processes. A cgroup that is gone is not populated.
+func cgroupPopulated(path string) bool {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	return !bytes.Contains(buf, []byte("populated 0"))
+}
+
+// waitForReboot reports whether a container came back up with a new init
+// process after oldPid exited, as happens when a system container reboots.
+// It returns the pid of the new init process.
+func waitForReboot(c *lxc.Container, oldPid int, timeout time.Duration) (int, bool) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		switch c.State() {
+		case lxc.STOPPED:
+			return 0, false
+		case lxc.RUNNING:
+			if pid := c.InitPid(); pid > 0 && pid != oldPid {
+				return pid, true
+			}
+		}
+		time.Sleep(containerRebootPollIntv)
+	}
+	return 0, false
+}
@@ -0,0 +1,343 @@
+package lxc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	lxc "github.com/lxc/go-lxc"
+	"golang.org/x/crypto/openpgp"
+)
+
+const (
+	// defaultImageServer is the image server of the download template
+	defaultImageServer = "images.linuxcontainers.org"
+
+	// imageVerificationFile records in a cached image directory which key
+	// signed the image fetched by the driver
+	imageVerificationFile = "nomad-gpg-verification.json"
+)
+
+// errNotFound is returned when the image server has no such file
+var errNotFound = errors.New("not found")
+
+// imageVerification is the result of verifying an image against the local
+// keyring
+type imageVerification struct {
+	Image  string `json:"image"`
+	Build  string `json:"build"`
+	Signer string `json:"signer"`
+
+	// cached is set if the image was verified when it was first fetched
+	cached bool
+
+	// err is set if the image failed verification
+	err error
+}
+
+// eventMessage describes the verification for a task event
+func (v *imageVerification) eventMessage() string {
+	switch {
+	case v.err != nil:
+		return fmt.Sprintf("Image %s failed signature verification: %v", v.Image, v.err)
+	case v.cached:
+		return fmt.Sprintf("Using cached image %s build %s verified with key %s", v.Image, v.Build, v.Signer)
+	default:
+		return fmt.Sprintf("Verified image %s build %s with key %s", v.Image, v.Build, v.Signer)
+	}
+}
+
+func (v *imageVerification) annotations() map[string]string {
+	return map[string]string{
+		"image":      v.Image,
+		"build":      v.Build,
+		"gpg_signer": v.Signer,
+		"verified":   strconv.FormatBool(v.err == nil),
+	}
+}
+
+// loadKeyring reads an armored or binary OpenPGP keyring
+func loadKeyring(path string) (openpgp.EntityList, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	keyring, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(buf))
+	if err != nil {
+		if keyring, err = openpgp.ReadKeyRing(bytes.NewReader(buf)); err != nil {
+			return nil, fmt.Errorf("failed to read keyring %s: %v", path, err)
+		}
+	}
+	if len(keyring) == 0 {
+		return nil, fmt.Errorf("keyring %s holds no keys", path)
+	}
+	return keyring, nil
+}
+
+// verifySignature checks the armored detached signature sig of signed
+// against keyring and returns the fingerprint of the signing key
+func verifySignature(keyring openpgp.EntityList, signed, sig io.Reader) (string, error) {
+	signer, err := openpgp.CheckArmoredDetachedSignature(keyring, signed, sig)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%X", signer.PrimaryKey.Fingerprint), nil
+}
+
+// verifyFile checks the detached signature at sigPath of the file at path
+func verifyFile(keyring openpgp.EntityList, path, sigPath string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	sig, err := os.Open(sigPath)
+	if err != nil {
+		return "", err
+	}
+	defer sig.Close()
+
+	signer, err := verifySignature(keyring, f, sig)
+	if err != nil {
+		return "", fmt.Errorf("bad signature for %s: %v", filepath.Base(path), err)
+	}
+	return signer, nil
+}
+
+// findImagePath returns the build and path on the image server of the image
+// key from the server index, whose lines read
+// distro;release;arch;variant;build;path
+func findImagePath(index io.Reader, key imageKey) (string, string, error) {
+	scanner := bufio.NewScanner(index)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ";")
+		if len(fields) != 6 {
+			continue
+		}
+		if fields[0] == key.distro && fields[1] == key.release && fields[2] == key.arch && fields[3] == key.variant {
+			return fields[4], strings.Trim(fields[5], "/"), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", "", err
+	}
+	return "", "", fmt.Errorf("image %s not found on the image server", key)
+}
+
+// useKeyring reports whether the image of opts is fetched and verified by
+// the driver against the local keyring, rather than by the download template
+// against a key server
+func (d *Driver) useKeyring(opts lxc.TemplateOptions) bool {
+	return d.currentConfig().GPGKeyring != "" && opts.Template == downloadTemplate && !opts.DisableGPGValidation
+}
+
+// fetchVerifiedImage puts the image of opts in the download template cache,
+// fetching it from the image server and verifying it against the local
+// keyring unless a copy verified with a key still in the keyring is already
+// cached and unexpired. The index of the server must be signed as well, or
+// the server could serve an older build. The download template then creates
+// the container from the cache. Unless exclusive, other containers may be
+// created from the cached image, so errImageStale is returned rather than
+// replacing it.
+func (d *Driver) fetchVerifiedImage(ctx context.Context, opts lxc.TemplateOptions, exclusive bool) (*imageVerification, error) {
+	key := imageKeyFromOptions(opts)
+	dir := key.path(d.downloadCacheDir())
+	v := &imageVerification{Image: key.String()}
+
+	unlock := d.imageFetchLocks.lock(key.String())
+	defer unlock()
+
+	keyring, err := loadKeyring(d.currentConfig().GPGKeyring)
+	if err != nil {
+		return nil, err
+	}
+
+	if !opts.FlushCache {
+		cached, err := readImageVerification(dir, keyring)
+		if err == nil {
+			cached.cached = true
+			return cached, nil
+		}
+		if !exclusive {
+			return nil, errImageStale
+		}
+		if !os.IsNotExist(err) {
+			d.logger.Info("fetching image again", "image", key, "reason", err)
+		}
+	}
+
+	server := opts.Server
+	if server == "" {
+		server = defaultImageServer
+	}
+	baseURL := "https://" + server
+
+	if err := os.MkdirAll(filepath.Dir(dir), 0700); err != nil {
+		return nil, err
+	}
+	tmp, err := ioutil.TempDir(filepath.Dir(dir), filepath.Base(dir)+".tmp-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+
+	// the index maps the image to its latest build
+	mode := "system"
+	if os.Geteuid() != 0 {
+		mode = "user"
+	}
+	indexPath := filepath.Join(tmp, "index")
+	if err := fetchFile(ctx, baseURL+"/meta/1.0/index-"+mode, indexPath); err != nil {
+		return nil, fmt.Errorf("failed to fetch image index: %v", err)
+	}
+	switch err := fetchFile(ctx, baseURL+"/meta/1.0/index-"+mode+".asc", indexPath+".asc"); err {
+	case nil:
+		if _, err := verifyFile(keyring, indexPath, indexPath+".asc"); err != nil {
+			v.err = err
+			return v, err
+		}
+	case errNotFound:
+		v.err = fmt.Errorf("image server index is not signed")
+		return v, v.err
+	default:
+		return nil, fmt.Errorf("failed to fetch image index signature: %v", err)
+	}
+
+	index, err := os.Open(indexPath)
+	if err != nil {
+		return nil, err
+	}
+	build, path, err := findImagePath(index, key)
+	index.Close()
+	if err != nil {
+		return nil, err
+	}
+	v.Build = build
+
+	for _, file := range []string{"meta.tar.xz", "rootfs.tar.xz"} {
+		dst := filepath.Join(tmp, file)
+		if err := fetchFile(ctx, fmt.Sprintf("%s/%s/%s", baseURL, path, file), dst); err != nil {
+			return nil, fmt.Errorf("failed to fetch %s: %v", file, err)
+		}
+		if err := fetchFile(ctx, fmt.Sprintf("%s/%s/%s.asc", baseURL, path, file), dst+".asc"); err != nil {
+			return nil, fmt.Errorf("failed to fetch signature of %s: %v", file, err)
+		}
+
+		signer, err := verifyFile(keyring, dst, dst+".asc")
+		if err != nil {
+			v.err = err
+			return v, err
+		}
+		v.Signer = signer
+	}
+
+	// lay the image out as the download template caches it
+	out, err := exec.CommandContext(ctx, "tar", "-xJf", filepath.Join(tmp, "meta.tar.xz"), "-C", tmp).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("failed to unpack image metadata: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	for _, file := range []string{"index", "index.asc", "meta.tar.xz", "meta.tar.xz.asc", "rootfs.tar.xz.asc"} {
+		os.Remove(filepath.Join(tmp, file))
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmp, "build_id"), []byte(build+"\n"), 0644); err != nil {
+		return nil, err
+	}
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmp, imageVerificationFile), buf, 0644); err != nil {
+		return nil, err
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, dir); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// readImageVerification returns the verification of the image cached at dir,
+// which must be complete, unexpired and signed by a key of keyring
+func readImageVerification(dir string, keyring openpgp.EntityList) (*imageVerification, error) {
+	if _, err := os.Stat(filepath.Join(dir, "rootfs.tar.xz")); err != nil {
+		return nil, err
+	}
+
+	// the image metadata sets when the image should be refreshed
+	if buf, err := ioutil.ReadFile(filepath.Join(dir, "expiry")); err == nil {
+		expiry, err := strconv.ParseInt(strings.TrimSpace(string(buf)), 10, 64)
+		if err == nil && time.Now().Unix() > expiry {
+			return nil, fmt.Errorf("cached image expired")
+		}
+	}
+
+	buf, err := ioutil.ReadFile(filepath.Join(dir, imageVerificationFile))
+	if err != nil {
+		return nil, err
+	}
+	var v imageVerification
+	if err := json.Unmarshal(buf, &v); err != nil {
+		return nil, err
+	}
+	if !keyringHas(keyring, v.Signer) {
+		return nil, fmt.Errorf("cached image signed with key %s, which is no longer in the keyring", v.Signer)
+	}
+	return &v, nil
+}
+
+// keyringHas reports whether keyring holds the key with the given fingerprint
+func keyringHas(keyring openpgp.EntityList, fingerprint string) bool {
+	for _, e := range keyring {
+		if fmt.Sprintf("%X", e.PrimaryKey.Fingerprint) == fingerprint {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchFile downloads url to path
+func fetchFile(ctx context.Context, url, path string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return errNotFound
+	case resp.StatusCode != http.StatusOK:
+		return fmt.Errorf("unexpected response %s", resp.Status)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
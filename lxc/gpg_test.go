@@ -0,0 +1,91 @@
+package lxc
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/openpgp"
+)
+
+func TestLXCDriver_VerifySignature(t *testing.T) {
+	t.Parallel()
+
+	signer, err := openpgp.NewEntity("images", "", "images@example.com", nil)
+	require.NoError(t, err)
+	other, err := openpgp.NewEntity("other", "", "other@example.com", nil)
+	require.NoError(t, err)
+
+	content := []byte("rootfs")
+	var sig bytes.Buffer
+	require.NoError(t, openpgp.ArmoredDetachSign(&sig, signer, bytes.NewReader(content), nil))
+
+	fingerprint, err := verifySignature(openpgp.EntityList{signer}, bytes.NewReader(content), bytes.NewReader(sig.Bytes()))
+	require.NoError(t, err)
+	require.Equal(t, fmt.Sprintf("%X", signer.PrimaryKey.Fingerprint), fingerprint)
+
+	// tampered content
+	_, err = verifySignature(openpgp.EntityList{signer}, strings.NewReader("tampered"), bytes.NewReader(sig.Bytes()))
+	require.Error(t, err)
+
+	// untrusted signer
+	_, err = verifySignature(openpgp.EntityList{other}, bytes.NewReader(content), bytes.NewReader(sig.Bytes()))
+	require.Error(t, err)
+}
+
+func TestLXCDriver_FindImagePath(t *testing.T) {
+	t.Parallel()
+
+	index := "alpine;3.15;amd64;default;20220310_13:00;/images/alpine/3.15/amd64/default/20220310_13:00/\n" +
+		"ubuntu;jammy;amd64;cloud;20220310_07:42;/images/ubuntu/jammy/amd64/cloud/20220310_07:42/\n"
+
+	build, path, err := findImagePath(strings.NewReader(index), imageKey{distro: "ubuntu", release: "jammy", arch: "amd64", variant: "cloud"})
+	require.NoError(t, err)
+	require.Equal(t, "20220310_07:42", build)
+	require.Equal(t, "images/ubuntu/jammy/amd64/cloud/20220310_07:42", path)
+
+	_, _, err = findImagePath(strings.NewReader(index), imageKey{distro: "ubuntu", release: "jammy", arch: "amd64", variant: "default"})
+	require.EqualError(t, err, "image ubuntu/jammy/amd64/default not found on the image server")
+}
+
+func TestLXCDriver_ReadImageVerification(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "lxc-gpg")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	signer, err := openpgp.NewEntity("images", "", "images@example.com", nil)
+	require.NoError(t, err)
+	other, err := openpgp.NewEntity("other", "", "other@example.com", nil)
+	require.NoError(t, err)
+	fingerprint := fmt.Sprintf("%X", signer.PrimaryKey.Fingerprint)
+	keyring := openpgp.EntityList{other, signer}
+
+	// images fetched by the download template itself have no verification
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "rootfs.tar.xz"), nil, 0600))
+	_, err = readImageVerification(dir, keyring)
+	require.Error(t, err)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, imageVerificationFile),
+		[]byte(`{"image":"alpine/3.15/amd64/default","build":"20220310_13:00","signer":"`+fingerprint+`"}`), 0600))
+	v, err := readImageVerification(dir, keyring)
+	require.NoError(t, err)
+	require.Equal(t, fingerprint, v.Signer)
+
+	// the signing key was removed from the keyring since
+	_, err = readImageVerification(dir, openpgp.EntityList{other})
+	require.EqualError(t, err, fmt.Sprintf("cached image signed with key %s, which is no longer in the keyring", fingerprint))
+
+	expiry := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "expiry"), []byte(expiry), 0600))
+	_, err = readImageVerification(dir, keyring)
+	require.EqualError(t, err, "cached image expired")
+}
@@ -2,30 +2,61 @@ package lxc
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	hclog "github.com/hashicorp/go-hclog"
+	multierror "github.com/hashicorp/go-multierror"
 	"github.com/hashicorp/nomad/client/stats"
+	"github.com/hashicorp/nomad/drivers/shared/eventer"
 	"github.com/hashicorp/nomad/plugins/drivers"
 	lxc "github.com/lxc/go-lxc"
+	"golang.org/x/sys/unix"
 )
 
 type taskHandle struct {
 	container *lxc.Container
-	initPid   int
 	logger    hclog.Logger
 
+	// systemContainer is set if the container boots its own init rather
+	// than running the task command; see bootModeSystem
+	systemContainer bool
+
+	// networkMode and mounts are what the container was started with
+	networkMode string
+	mounts      []string
+
+	// backingStore is the backing store of the container rootfs
+	backingStore string
+
+	// eventer is the driver eventer used to emit task events
+	eventer *eventer.Eventer
+
+	// exitMonitor reports the exit status of the container init process; it
+	// is nil if the lxc monitor could not be reached
+	exitMonitor *exitMonitor
+
 	totalCpuStats  *stats.CpuStats
 	userCpuStats   *stats.CpuStats
 	systemCpuStats *stats.CpuStats
 
+	// doneCh is closed once the task has exited and its exit result is set
+	doneCh chan struct{}
+
 	// stateLock syncs access to all fields below
 	stateLock sync.RWMutex
 
+	// initPid changes when a system container reboots
+	initPid int
+
 	taskConfig  *drivers.TaskConfig
 	procState   drivers.TaskState
 	startedAt   time.Time
@@ -51,11 +82,20 @@ func (h *taskHandle) TaskStatus() *drivers.TaskStatus {
 		CompletedAt: h.completedAt,
 		ExitResult:  h.exitResult,
 		DriverAttributes: map[string]string{
-			"pid": strconv.Itoa(h.initPid),
+			"pid":          strconv.Itoa(h.initPid),
+			"network_mode": h.networkMode,
+			"backingstore": h.backingStore,
 		},
 	}
 }
 
+// pid returns the pid of the container init process
+func (h *taskHandle) pid() int {
+	h.stateLock.RLock()
+	defer h.stateLock.RUnlock()
+	return h.initPid
+}
+
 func (h *taskHandle) IsRunning() bool {
 	h.stateLock.RLock()
 	defer h.stateLock.RUnlock()
@@ -69,20 +109,237 @@ func (h *taskHandle) run() {
 	}
 	h.stateLock.Unlock()
 
-	if ok, err := waitTillStopped(h.container); !ok {
-		h.logger.Error("failed to find container process", "error", err)
-		return
+	pid := h.pid()
+	oomWatcher := h.watchOOM(pid)
+	oomKilled := false
+
+	for {
+		if err := waitForExit(h.container, pid, h.exitMonitor, h.logger); err != nil {
+			h.logger.Error("failed to find container process", "error", err)
+			oomWatcher.stop()
+			h.markExited(&drivers.ExitResult{
+				Err: fmt.Errorf("failed to watch container process: %v", err),
+			})
+			return
+		}
+
+		if !h.systemContainer {
+			break
+		}
+
+		// the init of a system container may have exited because the
+		// container rebooted, in which case liblxc starts it again
+		newPid, ok := waitForReboot(h.container, pid, containerRebootTimeout)
+		if !ok {
+			break
+		}
+
+		h.logger.Info("system container rebooted", "container", h.container.Name(), "pid", newPid)
+		h.emitEvent("Container rebooted", nil)
+
+		h.stateLock.Lock()
+		h.initPid = newPid
+		h.stateLock.Unlock()
+		pid = newPid
+
+		if h.exitMonitor != nil {
+			h.exitMonitor.close()
+			mon, err := newExitMonitor(h.container.ConfigPath(), h.container.Name())
+			if err != nil {
+				h.logger.Warn("failed to monitor container exit status", "error", err)
+			}
+			h.exitMonitor = mon
+		}
+
+		// lxc recreates the container cgroups on reboot
+		oomKilled = oomWatcher.stop() || oomKilled
+		oomWatcher = h.watchOOM(pid)
 	}
 
-	h.stateLock.Lock()
-	defer h.stateLock.Unlock()
+	exitCode, signal := 0, 0
+	if h.exitMonitor != nil {
+		status, err := h.exitMonitor.wait(containerExitStatusTimeout)
+		if err != nil {
+			h.logger.Warn("failed to get container exit status", "error", err)
+		} else {
+			exitCode, signal = exitCodeFromStatus(status)
+		}
+	} else {
+		h.logger.Warn("lxc monitor unavailable, container exit status unknown")
+	}
+
+	oomKilled = oomWatcher.stop() || oomKilled
+
+	h.markExited(&drivers.ExitResult{
+		ExitCode:  exitCode,
+		Signal:    signal,
+		OOMKilled: oomKilled,
+	})
+
+	if oomKilled {
+		h.logger.Info("task was killed by the OOM killer", "container", h.container.Name())
+		annotations := map[string]string{}
+		if r := h.taskConfig.Resources; r != nil && r.NomadResources != nil {
+			annotations["memory_limit_mb"] = strconv.FormatInt(r.NomadResources.Memory.MemoryMB, 10)
+		}
+		h.emitEvent("OOM killer terminated a process in the container; the task exceeded its memory limit", annotations)
+	}
+}
 
+// markExited records the exit of the task, wakes up WaitTask callers and
+// persists the exit result so it survives a Nomad client restart
+func (h *taskHandle) markExited(result *drivers.ExitResult) {
+	h.stateLock.Lock()
 	h.procState = drivers.TaskStateExited
-	h.exitResult.ExitCode = 0
-	h.exitResult.Signal = 0
+	h.exitResult = result
 	h.completedAt = time.Now()
+	h.stateLock.Unlock()
 
-	// TODO: detect if the task OOMed
+	// wake up WaitTask callers
+	close(h.doneCh)
+
+	if err := h.saveState(); err != nil {
+		h.logger.Warn("failed to persist task state", "error", err)
+	}
+}
+
+// oomWatcher samples the OOM kill counter of a container memory cgroup. The
+// cgroup is removed by lxc shortly after the container stops, so the counter
+// is polled while the container runs rather than only read after exit.
+type oomWatcher struct {
+	cgroup *memoryCgroup
+	logger hclog.Logger
+
+	stopCh chan struct{}
+	doneCh chan struct{}
+
+	// oomKilled is only read after doneCh is closed
+	oomKilled bool
+}
+
+// watchOOM starts watching the memory cgroup of the container for OOM kills.
+// The returned watcher is always usable, even if the cgroup cannot be found.
+func (h *taskHandle) watchOOM(pid int) *oomWatcher {
+	w := &oomWatcher{
+		logger: h.logger,
+		stopCh: make(chan struct{}),
+		doneCh: make(chan struct{}),
+	}
+
+	cg, err := containerMemoryCgroup(pid)
+	if err != nil {
+		h.logger.Warn("failed to find container memory cgroup, OOM kills will not be detected", "error", err)
+		close(w.doneCh)
+		return w
+	}
+	w.cgroup = cg
+
+	go w.run()
+	return w
+}
+
+func (w *oomWatcher) run() {
+	defer close(w.doneCh)
+
+	ticker := time.NewTicker(oomCheckIntv)
+	defer ticker.Stop()
+
+	for {
+		w.check()
+		if w.oomKilled {
+			return
+		}
+
+		select {
+		case <-w.stopCh:
+			// one last look, the cgroup may still be around
+			w.check()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (w *oomWatcher) check() {
+	n, err := w.cgroup.oomKillCount()
+	if err != nil {
+		// expected once the container is gone
+		w.logger.Trace("failed to read OOM kill count", "cgroup", w.cgroup.dir, "error", err)
+		return
+	}
+	if n > 0 {
+		w.oomKilled = true
+	}
+}
+
+// stop stops the watcher and returns whether an OOM kill was observed
+func (w *oomWatcher) stop() bool {
+	select {
+	case <-w.stopCh:
+	default:
+		close(w.stopCh)
+	}
+	<-w.doneCh
+	return w.oomKilled
+}
+
+// emitEvent sends a task event for this task through the driver eventer
+func (h *taskHandle) emitEvent(message string, annotations map[string]string) {
+	emitTaskEvent(h.eventer, h.logger, h.taskConfig, message, annotations)
+}
+
+// saveState persists the state of the task into the task directory. The
+// handle returned by StartTask cannot be updated after the fact, so this is
+// how state observed by this driver, such as the exit of the task, survives a
+// Nomad client restart.
+func (h *taskHandle) saveState() error {
+	h.stateLock.RLock()
+	state := TaskState{
+		ContainerName: h.container.Name(),
+		StartedAt:     h.startedAt,
+		NetworkMode:   h.networkMode,
+		Mounts:        h.mounts,
+		BackingStore:  h.backingStore,
+		Exited:        h.procState == drivers.TaskStateExited,
+		CompletedAt:   h.completedAt,
+	}
+	if h.exitResult != nil {
+		state.setExitResult(h.exitResult)
+	}
+	path := taskStatePath(h.taskConfig)
+	h.stateLock.RUnlock()
+
+	buf, err := json.Marshal(&state)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// loadTaskState reads the state persisted by saveState, returning nil if none
+// was saved
+func loadTaskState(cfg *drivers.TaskConfig) (*TaskState, error) {
+	buf, err := ioutil.ReadFile(taskStatePath(cfg))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var state TaskState
+	if err := json.Unmarshal(buf, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+func taskStatePath(cfg *drivers.TaskConfig) string {
+	return filepath.Join(cfg.TaskDir().Dir, taskStateFile)
 }
 
 func (h *taskHandle) stats(ctx context.Context, interval time.Duration) (<-chan *drivers.TaskResourceUsage, error) {
@@ -205,17 +462,77 @@ func keysToVal(line string) (string, uint64, error) {
 	return key, val, err
 }
 
-// shutdown shuts down the container, with `timeout` grace period
-// before killing the container with SIGKILL.
-func (h *taskHandle) shutdown(timeout time.Duration) error {
-	err := h.container.Shutdown(timeout)
-	if err == nil || strings.Contains(err.Error(), "not running") {
-		return nil
+// shutdown stops the task. If sig is non-zero it is sent to the task process;
+// otherwise liblxc asks the container to halt with its lxc.signal.halt. Either
+// way the container gets a `timeout` grace period to exit before it is killed.
+func (h *taskHandle) shutdown(sig syscall.Signal, timeout time.Duration) error {
+	if sig == 0 {
+		h.emitEvent(fmt.Sprintf("Requesting container halt, waiting up to %s", timeout), nil)
+		err := h.container.Shutdown(timeout)
+		if err == nil || strings.Contains(err.Error(), "not running") {
+			h.emitEvent("Container halted", nil)
+			return nil
+		}
+		h.logger.Debug("container did not halt in time", "error", err)
+	} else {
+		h.emitEvent(fmt.Sprintf("Sent signal %s to task, waiting up to %s", unix.SignalName(sig), timeout), nil)
+		if err := h.signal(sig, false); err != nil {
+			h.logger.Warn("failed to send kill signal to task", "signal", sig, "error", err)
+		} else if h.waitExited(timeout) {
+			h.emitEvent("Task exited", nil)
+			return nil
+		}
 	}
 
-	err = h.container.Stop()
+	h.emitEvent(fmt.Sprintf("Task did not exit within %s, stopping container", timeout), nil)
+	err := h.container.Stop()
 	if err == nil || strings.Contains(err.Error(), "not running") {
+		h.emitEvent("Container stopped", nil)
 		return nil
 	}
 	return err
 }
+
+// waitExited waits up to timeout for the task to exit, returning whether it did
+func (h *taskHandle) waitExited(timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-h.doneCh:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// signal sends sig to the container init process, which forwards it to the
+// task command. If all is set, sig is sent to every process in the container
+// cgroup instead.
+func (h *taskHandle) signal(sig syscall.Signal, all bool) error {
+	if !h.IsRunning() {
+		return fmt.Errorf("task is not running")
+	}
+
+	initPid := h.pid()
+	if !all {
+		if err := unix.Kill(initPid, sig); err != nil {
+			return fmt.Errorf("failed to signal container init process: %v", err)
+		}
+		return nil
+	}
+
+	pids, err := cgroupPids(initPid)
+	if err != nil {
+		return fmt.Errorf("failed to list container processes: %v", err)
+	}
+
+	var mErr multierror.Error
+	for _, pid := range pids {
+		// processes may exit while we iterate
+		if err := unix.Kill(pid, sig); err != nil && err != unix.ESRCH {
+			multierror.Append(&mErr, fmt.Errorf("failed to signal pid %d: %v", pid, err))
+		}
+	}
+	return mErr.ErrorOrNil()
+}
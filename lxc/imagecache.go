@@ -0,0 +1,367 @@
+package lxc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	lxc "github.com/lxc/go-lxc"
+)
+
+const (
+	// imageCacheEnv is the environment variable read by the download
+	// template for the base directory of its cache
+	imageCacheEnv = "LXC_CACHE_PATH"
+
+	// imageLastUsedFile is touched in a cached image directory every time the
+	// image is used; its modification time orders the LRU eviction
+	imageLastUsedFile = ".nomad-last-used"
+
+	// defaultImageVariant is the variant used by the download template if
+	// none is given
+	defaultImageVariant = "default"
+)
+
+// errImageStale is returned by the create function of an image cache run
+// under the read lock of a cached image that must be fetched again; it then
+// runs again under the write lock
+var errImageStale = errors.New("cached image must be fetched again")
+
+// ImageCacheConfig is the configuration of the driver managed image cache
+type ImageCacheConfig struct {
+	// Dir is the cache directory of the download template. The cache is left
+	// to liblxc if it is empty. The template reads it from the environment
+	// of the plugin, so it can't be changed without restarting the plugin.
+	Dir string `codec:"dir"`
+
+	// MaxSizeMB is the size above which the least recently used images are
+	// evicted; zero means unlimited
+	MaxSizeMB int `codec:"max_size_mb"`
+}
+
+// imageKey identifies an image in the download template cache
+type imageKey struct {
+	distro  string
+	release string
+	arch    string
+	variant string
+}
+
+func imageKeyFromOptions(opts lxc.TemplateOptions) imageKey {
+	variant := opts.Variant
+	if variant == "" {
+		variant = defaultImageVariant
+	}
+	return imageKey{distro: opts.Distro, release: opts.Release, arch: opts.Arch, variant: variant}
+}
+
+func (k imageKey) String() string {
+	return fmt.Sprintf("%s/%s/%s/%s", k.distro, k.release, k.arch, k.variant)
+}
+
+// path returns the directory of the image in the cache; this is the layout
+// of the download template
+func (k imageKey) path(dir string) string {
+	return filepath.Join(dir, "download", k.distro, k.release, k.arch, k.variant)
+}
+
+// imageCacheEntry serializes the downloads of an image. Containers are
+// created from a cached image under a read lock, while downloading the image
+// takes the write lock.
+type imageCacheEntry struct {
+	lock sync.RWMutex
+
+	// users is the number of creates using the entry, guarded by the cache
+	// lock; images in use are never evicted
+	users int
+}
+
+// imageCache manages the cache of the download template so that concurrent
+// tasks download each image once, and the cache stays under a size limit
+type imageCache struct {
+	dir    string
+	logger hclog.Logger
+
+	// lock guards maxBytes and entries
+	lock     sync.Mutex
+	maxBytes int64
+	entries  map[imageKey]*imageCacheEntry
+}
+
+// newImageCache creates the image cache of cfg and points the download
+// template of the plugin process at it. It must only be called once.
+func newImageCache(cfg ImageCacheConfig, logger hclog.Logger) (*imageCache, error) {
+	if cfg.MaxSizeMB < 0 {
+		return nil, fmt.Errorf("image_cache.max_size_mb must not be negative")
+	}
+	if err := os.MkdirAll(cfg.Dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create image cache directory: %v", err)
+	}
+
+	// the download template runs as a child of the plugin and inherits its
+	// environment
+	if err := os.Setenv(imageCacheEnv, cfg.Dir); err != nil {
+		return nil, err
+	}
+
+	return &imageCache{
+		dir:      cfg.Dir,
+		maxBytes: int64(cfg.MaxSizeMB) * 1024 * 1024,
+		logger:   logger.Named("image_cache"),
+		entries:  map[imageKey]*imageCacheEntry{},
+	}, nil
+}
+
+// reconfigureImageCache returns the image cache for cfg given the current
+// one, which is kept so that the locks of running creates stay valid. Only
+// the size limit can change once the cache is set up.
+func reconfigureImageCache(current *imageCache, cfg ImageCacheConfig, logger hclog.Logger) (*imageCache, error) {
+	if current == nil {
+		if cfg.Dir == "" {
+			return nil, nil
+		}
+		return newImageCache(cfg, logger)
+	}
+
+	if cfg.Dir != current.dir {
+		return nil, fmt.Errorf("image_cache.dir can't be changed from %q without restarting the plugin", current.dir)
+	}
+	if cfg.MaxSizeMB < 0 {
+		return nil, fmt.Errorf("image_cache.max_size_mb must not be negative")
+	}
+	current.lock.Lock()
+	current.maxBytes = int64(cfg.MaxSizeMB) * 1024 * 1024
+	current.lock.Unlock()
+	return current, nil
+}
+
+// cached reports whether the image is in the cache
+func (ic *imageCache) cached(key imageKey) bool {
+	_, err := os.Stat(filepath.Join(key.path(ic.dir), "rootfs.tar.xz"))
+	return err == nil
+}
+
+// create runs fn, which creates a container from the image with opts,
+// holding the lock of the image so that only one download of an image runs
+// at a time. fn is told whether it holds the write lock, without which it
+// must not replace the image. The image is then marked as used and the cache
+// trimmed to its size limit. The returned bool is true if the image was
+// already cached.
+func (ic *imageCache) create(opts lxc.TemplateOptions, fn func(exclusive bool) error) (bool, error) {
+	key := imageKeyFromOptions(opts)
+
+	ic.lock.Lock()
+	entry, ok := ic.entries[key]
+	if !ok {
+		entry = &imageCacheEntry{}
+		ic.entries[key] = entry
+	}
+	entry.users++
+	ic.lock.Unlock()
+
+	defer func() {
+		ic.lock.Lock()
+		entry.users--
+		ic.lock.Unlock()
+	}()
+
+	hit, err := ic.runLocked(entry, key, opts, fn)
+	if err != nil {
+		return hit, err
+	}
+
+	ic.touch(key)
+	ic.evict()
+	return hit, nil
+}
+
+// runLocked runs fn under a read lock of the image if it is cached, and under
+// the write lock otherwise since fn then downloads the image. A flush replaces
+// the cached image, so it needs the write lock too, as does a cached image fn
+// finds stale.
+func (ic *imageCache) runLocked(entry *imageCacheEntry, key imageKey, opts lxc.TemplateOptions, fn func(exclusive bool) error) (bool, error) {
+	if !opts.FlushCache {
+		entry.lock.RLock()
+		if ic.cached(key) {
+			err := fn(false)
+			entry.lock.RUnlock()
+			if err != errImageStale {
+				return true, err
+			}
+			ic.logger.Debug("fetching stale image under the write lock", "image", key)
+		} else {
+			entry.lock.RUnlock()
+		}
+	}
+
+	entry.lock.Lock()
+	defer entry.lock.Unlock()
+
+	// another task may have downloaded the image while we waited
+	hit := !opts.FlushCache && ic.cached(key)
+	return hit, fn(true)
+}
+
+// touch marks the image as just used
+func (ic *imageCache) touch(key imageKey) {
+	path := filepath.Join(key.path(ic.dir), imageLastUsedFile)
+	now := time.Now()
+	if err := os.Chtimes(path, now, now); err != nil {
+		if err := ioutil.WriteFile(path, nil, 0600); err != nil {
+			ic.logger.Warn("failed to mark image as used", "image", key, "error", err)
+		}
+	}
+}
+
+// cachedImage is an image found in the cache directory
+type cachedImage struct {
+	key      imageKey
+	size     int64
+	lastUsed time.Time
+}
+
+// images lists the images in the cache directory
+func (ic *imageCache) images() []*cachedImage {
+	return listCachedImages(ic.dir, true)
+}
+
+// listCachedImages lists the images in the download template cache at dir,
+// with their disk usage if withSize is set
+func listCachedImages(dir string, withSize bool) []*cachedImage {
+	paths, _ := filepath.Glob(filepath.Join(dir, "download", "*", "*", "*", "*"))
+
+	var images []*cachedImage
+	for _, path := range paths {
+		rel, err := filepath.Rel(filepath.Join(dir, "download"), path)
+		if err != nil {
+			continue
+		}
+		parts := strings.Split(rel, string(filepath.Separator))
+		if len(parts) != 4 {
+			continue
+		}
+
+		info, err := os.Stat(filepath.Join(path, imageLastUsedFile))
+		if err != nil {
+			if info, err = os.Stat(path); err != nil {
+				continue
+			}
+		}
+
+		img := &cachedImage{
+			key:      imageKey{distro: parts[0], release: parts[1], arch: parts[2], variant: parts[3]},
+			lastUsed: info.ModTime(),
+		}
+		if withSize {
+			img.size = dirSize(path)
+		}
+		images = append(images, img)
+	}
+	return images
+}
+
+// lruEvictions returns the least recently used images to remove for the
+// cache to fit in maxBytes, skipping the images for which inUse is true
+func lruEvictions(images []*cachedImage, maxBytes int64, inUse func(imageKey) bool) []*cachedImage {
+	var total int64
+	for _, img := range images {
+		total += img.size
+	}
+	if maxBytes <= 0 || total <= maxBytes {
+		return nil
+	}
+
+	sorted := make([]*cachedImage, len(images))
+	copy(sorted, images)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].lastUsed.Before(sorted[j].lastUsed)
+	})
+
+	var evict []*cachedImage
+	for _, img := range sorted {
+		if total <= maxBytes {
+			break
+		}
+		if inUse(img.key) {
+			continue
+		}
+		evict = append(evict, img)
+		total -= img.size
+	}
+	return evict
+}
+
+// evict removes the least recently used images that are not in use until the
+// cache is under its size limit
+func (ic *imageCache) evict() {
+	ic.lock.Lock()
+	defer ic.lock.Unlock()
+
+	if ic.maxBytes <= 0 {
+		return
+	}
+
+	inUse := func(key imageKey) bool {
+		entry, ok := ic.entries[key]
+		return ok && entry.users > 0
+	}
+
+	for _, img := range lruEvictions(ic.images(), ic.maxBytes, inUse) {
+		if err := os.RemoveAll(img.key.path(ic.dir)); err != nil {
+			ic.logger.Warn("failed to evict image", "image", img.key, "error", err)
+			continue
+		}
+		delete(ic.entries, img.key)
+		ic.logger.Info("evicted image", "image", img.key, "size_mb", img.size/1024/1024, "last_used", img.lastUsed)
+	}
+}
+
+// rootfsCreation describes how a container rootfs was created
+type rootfsCreation struct {
+	// cached is set if the image was already in the cache
+	cached bool
+
+	// verification is the result of verifying the image against the local
+	// keyring, if the driver config has one
+	verification *imageVerification
+}
+
+// createRootfs creates the rootfs of the container with opts, going through
+// the image cache for the download template. Images are verified against the
+// local keyring first if the driver config has one.
+func (d *Driver) createRootfs(ctx context.Context, c *lxc.Container, opts lxc.TemplateOptions) (*rootfsCreation, error) {
+	res := &rootfsCreation{}
+	create := func(exclusive bool) error {
+		if d.useKeyring(opts) {
+			v, err := d.fetchVerifiedImage(ctx, opts, exclusive)
+			res.verification = v
+			if err != nil {
+				return err
+			}
+			d.logger.Info("verified image against local keyring", "image", v.Image, "build", v.Build, "signer", v.Signer, "cached", v.cached)
+
+			// the image is cached; the template must not fetch it again
+			// without the local keyring
+			opts.FlushCache = false
+			opts.ForceCache = true
+		}
+		return createContainer(ctx, c, opts)
+	}
+
+	cache := d.currentImageCache()
+	if cache == nil || opts.Template != downloadTemplate {
+		return res, create(true)
+	}
+
+	var err error
+	res.cached, err = cache.create(opts, create)
+	return res, err
+}
@@ -0,0 +1,217 @@
+package lxc
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/nomad/helper/testlog"
+	lxc "github.com/lxc/go-lxc"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLXCDriver_ImageCacheDedupe(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "lxc-image-cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ic := &imageCache{
+		dir:     dir,
+		logger:  testlog.HCLogger(t),
+		entries: map[imageKey]*imageCacheEntry{},
+	}
+
+	opts := lxc.TemplateOptions{Template: "download", Distro: "alpine", Release: "3.15", Arch: "amd64"}
+	imageDir := imageKeyFromOptions(opts).path(dir)
+	require.Equal(t, filepath.Join(dir, "download", "alpine", "3.15", "amd64", "default"), imageDir)
+
+	// each create downloads the image unless it is already cached, like the
+	// download template
+	var downloads int32
+	create := func(bool) error {
+		if _, err := os.Stat(filepath.Join(imageDir, "rootfs.tar.xz")); err == nil {
+			return nil
+		}
+		atomic.AddInt32(&downloads, 1)
+		time.Sleep(50 * time.Millisecond)
+		require.NoError(t, os.MkdirAll(imageDir, 0700))
+		return ioutil.WriteFile(filepath.Join(imageDir, "rootfs.tar.xz"), []byte("image"), 0600)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := ic.create(opts, create)
+			require.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, int32(1), downloads)
+
+	hit, err := ic.create(opts, create)
+	require.NoError(t, err)
+	require.True(t, hit)
+	require.FileExists(t, filepath.Join(imageDir, imageLastUsedFile))
+}
+
+func TestLXCDriver_ImageCacheStale(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "lxc-image-cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ic := &imageCache{
+		dir:     dir,
+		logger:  testlog.HCLogger(t),
+		entries: map[imageKey]*imageCacheEntry{},
+	}
+
+	opts := lxc.TemplateOptions{Template: "download", Distro: "alpine", Release: "3.15", Arch: "amd64"}
+	key := imageKeyFromOptions(opts)
+	require.NoError(t, os.MkdirAll(key.path(dir), 0700))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(key.path(dir), "rootfs.tar.xz"), []byte("image"), 0600))
+
+	// a reader of the cached image holds the read lock
+	ic.entries[key] = &imageCacheEntry{}
+	ic.entries[key].lock.RLock()
+	released := make(chan struct{})
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(released)
+		ic.entries[key].lock.RUnlock()
+	}()
+
+	// the stale image is only replaced under the write lock, once the reader
+	// is done
+	var calls []bool
+	_, err = ic.create(opts, func(exclusive bool) error {
+		calls = append(calls, exclusive)
+		if !exclusive {
+			return errImageStale
+		}
+		select {
+		case <-released:
+		default:
+			t.Error("image replaced while a reader holds it")
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []bool{false, true}, calls)
+}
+
+func TestLXCDriver_ReconfigureImageCache(t *testing.T) {
+	t.Parallel()
+
+	logger := testlog.HCLogger(t)
+
+	ic, err := reconfigureImageCache(nil, ImageCacheConfig{}, logger)
+	require.NoError(t, err)
+	require.Nil(t, ic)
+
+	current := &imageCache{dir: "/var/cache/nomad-lxc", logger: logger, entries: map[imageKey]*imageCacheEntry{}}
+
+	// the cache and the locks of running creates are kept
+	ic, err = reconfigureImageCache(current, ImageCacheConfig{Dir: "/var/cache/nomad-lxc", MaxSizeMB: 10}, logger)
+	require.NoError(t, err)
+	require.True(t, ic == current)
+	require.Equal(t, int64(10*1024*1024), ic.maxBytes)
+
+	// running templates would keep using the previous directory
+	_, err = reconfigureImageCache(current, ImageCacheConfig{Dir: "/srv/lxc-cache"}, logger)
+	require.EqualError(t, err, `image_cache.dir can't be changed from "/var/cache/nomad-lxc" without restarting the plugin`)
+	_, err = reconfigureImageCache(current, ImageCacheConfig{}, logger)
+	require.Error(t, err)
+
+	_, err = reconfigureImageCache(current, ImageCacheConfig{Dir: "/var/cache/nomad-lxc", MaxSizeMB: -1}, logger)
+	require.Error(t, err)
+}
+
+func TestLXCDriver_LRUEvictions(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	a := &cachedImage{key: imageKey{distro: "a"}, size: 10, lastUsed: now.Add(-3 * time.Hour)}
+	b := &cachedImage{key: imageKey{distro: "b"}, size: 10, lastUsed: now.Add(-2 * time.Hour)}
+	c := &cachedImage{key: imageKey{distro: "c"}, size: 10, lastUsed: now.Add(-1 * time.Hour)}
+	images := []*cachedImage{c, a, b}
+	notInUse := func(imageKey) bool { return false }
+
+	require.Empty(t, lruEvictions(images, 30, notInUse))
+	require.Empty(t, lruEvictions(images, 0, notInUse))
+	require.Equal(t, []*cachedImage{a, b}, lruEvictions(images, 10, notInUse))
+
+	// images in use are skipped
+	aInUse := func(k imageKey) bool { return k == a.key }
+	require.Equal(t, []*cachedImage{b}, lruEvictions(images, 20, aInUse))
+}
+
+func TestLXCDriver_ImageAttributes(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "lxc-image-cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, ref := range []string{"ubuntu/jammy/amd64", "alpine/3.15/arm64/cloud"} {
+		key, err := parseImageRef(ref)
+		require.NoError(t, err)
+		require.NoError(t, os.MkdirAll(key.path(dir), 0700))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(key.path(dir), "rootfs.tar.xz"), nil, 0600))
+	}
+
+	// an image still being downloaded
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "download", "debian", "bullseye", "amd64", "default"), 0700))
+
+	d := NewLXCDriver(testlog.HCLogger(t)).(*Driver)
+	d.imageCache = &imageCache{dir: dir}
+
+	attrs := d.imageAttributes()
+	require.Len(t, attrs, 2)
+	require.Contains(t, attrs, "driver.lxc.image.ubuntu.jammy.amd64")
+	require.Contains(t, attrs, "driver.lxc.image.alpine.3_15.arm64.cloud")
+}
+
+func TestLXCDriver_ParsePrepullImages(t *testing.T) {
+	t.Parallel()
+
+	keys, err := parsePrepullImages([]string{"ubuntu/jammy/amd64", "alpine/3.15/amd64/cloud"})
+	require.NoError(t, err)
+	require.Equal(t, []imageKey{
+		{distro: "ubuntu", release: "jammy", arch: "amd64", variant: "default"},
+		{distro: "alpine", release: "3.15", arch: "amd64", variant: "cloud"},
+	}, keys)
+
+	_, err = parsePrepullImages([]string{"ubuntu/jammy"})
+	require.EqualError(t, err, `prepull: invalid image "ubuntu/jammy", expected distro/release/arch[/variant]`)
+
+	_, err = parsePrepullImages([]string{"ubuntu/../amd64"})
+	require.Error(t, err)
+}
+
+func TestLXCDriver_PrepullSet(t *testing.T) {
+	t.Parallel()
+
+	jammy := imageKey{distro: "ubuntu", release: "jammy", arch: "amd64", variant: "default"}
+	alpine := imageKey{distro: "alpine", release: "3.15", arch: "amd64", variant: "cloud"}
+
+	s := newPrepullSet()
+	require.Equal(t, []imageKey{jammy}, s.add([]imageKey{jammy}))
+
+	// a later config only pre-pulls the images it adds
+	require.Equal(t, []imageKey{alpine}, s.add([]imageKey{jammy, alpine}))
+	require.Empty(t, s.add([]imageKey{alpine, jammy}))
+
+	// a failed pre-pull is retried by the next config
+	s.remove(alpine)
+	require.Equal(t, []imageKey{alpine}, s.add([]imageKey{jammy, alpine}))
+}
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
@@ -30,27 +32,161 @@ var (
 		"trace": lxc.TRACE,
 		"warn":  lxc.WARN,
 	}
+
+	// gpgKeyIDRe matches GPG key IDs and fingerprints as accepted by the
+	// download template
+	gpgKeyIDRe = regexp.MustCompile(`^(0x)?([0-9a-fA-F]{8}|[0-9a-fA-F]{16}|[0-9a-fA-F]{40})$`)
+)
+
+const (
+	// downloadTemplate is the liblxc template that fetches prebuilt images
+	// from an image server
+	downloadTemplate = "download"
+)
+
+const (
+	// bootModeCommand runs the task command as the container init through
+	// lxc-init, making it an application container
+	bootModeCommand = "command"
+
+	// bootModeSystem boots the container's own init system, making it a
+	// system container
+	bootModeSystem = "system"
+)
+
+const (
+	// restartModeRecreate creates the container from scratch every time the
+	// task starts, destroying any container left by a previous run
+	restartModeRecreate = "recreate"
+
+	// restartModeReuse starts the container left by a previous run of the
+	// task in the same allocation, keeping its root filesystem
+	restartModeReuse = "reuse"
 )
 
 const (
 	// containerMonitorIntv is the interval at which the driver checks if the
 	// container is still alive
 	containerMonitorIntv = 2 * time.Second
+
+	// containerExitStatusTimeout is how long to wait for the lxc monitor to
+	// report the exit status once the container init process is gone
+	containerExitStatusTimeout = 5 * time.Second
+
+	// containerRebootTimeout is how long to wait for a system container to
+	// come back up after its init exited before considering it stopped
+	containerRebootTimeout = 10 * time.Second
+
+	// containerRebootPollIntv is the interval at which the state of a system
+	// container is checked while waiting for it to reboot
+	containerRebootPollIntv = 100 * time.Millisecond
+
+	// recoverStartTimeSlack is how much later than the recorded task start
+	// time the init process of a recovered container may have started, to
+	// account for the precision of process start times
+	recoverStartTimeSlack = 5 * time.Second
+
+	// oomCheckIntv is the interval at which the driver samples the OOM kill
+	// counter of a running container
+	oomCheckIntv = 1 * time.Second
+
+	// taskStateFile is the file in the task directory holding the latest
+	// TaskState of the task
+	taskStateFile = "lxc-task-state.json"
 )
 
 func (d *Driver) lxcPath() string {
-	lxcPath := d.config.LXCPath
+	lxcPath := d.currentConfig().LXCPath
 	if lxcPath == "" {
 		lxcPath = lxc.DefaultConfigPath()
 	}
 	return lxcPath
 
 }
-func (d *Driver) initializeContainer(cfg *drivers.TaskConfig, taskConfig TaskConfig) (*lxc.Container, error) {
+
+// containerName returns the name of the container of a task. It is the same
+// for every run of the task within an allocation.
+func containerName(cfg *drivers.TaskConfig) string {
+	return fmt.Sprintf("%s-%s", cfg.Name, cfg.AllocID)
+}
+
+// bootMode returns the validated boot mode of the task
+func bootMode(taskConfig TaskConfig) (string, error) {
+	switch taskConfig.BootMode {
+	case "":
+		return bootModeCommand, nil
+	case bootModeCommand:
+		return bootModeCommand, nil
+	case bootModeSystem:
+		if len(taskConfig.Command) != 0 {
+			return "", fmt.Errorf("lxc driver config 'command' cannot be set when 'boot_mode' is %s", bootModeSystem)
+		}
+		return bootModeSystem, nil
+	default:
+		return "", fmt.Errorf("lxc driver config 'boot_mode' can only be either %s or %s", bootModeCommand, bootModeSystem)
+	}
+}
+
+// restartMode returns the validated restart mode of the task
+func restartMode(taskConfig TaskConfig) (string, error) {
+	switch taskConfig.RestartMode {
+	case "":
+		return restartModeRecreate, nil
+	case restartModeRecreate, restartModeReuse:
+		return taskConfig.RestartMode, nil
+	default:
+		return "", fmt.Errorf("lxc driver config 'restart_mode' can only be either %s or %s", restartModeRecreate, restartModeReuse)
+	}
+}
+
+// prepareContainerName deals with a container left under the task container
+// name, typically by a previous run of the task in the same allocation. A
+// running leftover is stopped; then it is kept if the task reuses its
+// container and destroyed otherwise. It returns whether the existing container
+// should be reused.
+func (d *Driver) prepareContainerName(name string, taskConfig TaskConfig) (bool, error) {
+	mode, err := restartMode(taskConfig)
+	if err != nil {
+		return false, err
+	}
+
+	c, err := lxc.NewContainer(name, d.lxcPath())
+	if err != nil {
+		return false, fmt.Errorf("failed to initialize container: %v", err)
+	}
+	defer c.Release()
+
+	if !c.Defined() {
+		return false, nil
+	}
+
+	if c.Running() {
+		d.logger.Warn("stopping leftover container", "container", name)
+		if err := c.Stop(); err != nil && !strings.Contains(err.Error(), "not running") {
+			return false, fmt.Errorf("failed to stop leftover container %q: %v", name, err)
+		}
+	}
+
+	if mode == restartModeReuse {
+		d.logger.Info("reusing existing container", "container", name)
+		return true, nil
+	}
+
+	d.logger.Info("destroying leftover container", "container", name)
+	if err := c.Destroy(); err != nil {
+		return false, fmt.Errorf("failed to destroy leftover container %q: %v", name, err)
+	}
+	return false, nil
+}
+
+// initializeContainer sets up the in-memory configuration of the task
+// container. If exists is set the container was left by a previous run or
+// cloned from a base container, and the configuration saved with it is
+// updated rather than rebuilt.
+func (d *Driver) initializeContainer(cfg *drivers.TaskConfig, taskConfig TaskConfig, exists bool) (*lxc.Container, error) {
 	lxcPath := d.lxcPath()
 
-	containerName := fmt.Sprintf("%s-%s", cfg.Name, cfg.AllocID)
-	c, err := lxc.NewContainer(containerName, lxcPath)
+	c, err := lxc.NewContainer(containerName(cfg), lxcPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize container: %v", err)
 	}
@@ -80,22 +216,24 @@ func (d *Driver) initializeContainer(cfg *drivers.TaskConfig, taskConfig TaskCon
 	// set cgroup dir
 	c.SetConfigItem("lxc.cgroup.dir", taskConfig.Cgroup)
 
-	// set environment
-	for _, env := range taskConfig.Environment {
-		c.SetConfigItem("lxc.environment", env)
+	// set environment; the task environment may have changed since the
+	// container was created
+	if exists {
+		if err := c.ClearConfigItem("lxc.environment"); err != nil {
+			return nil, fmt.Errorf("failed to clear container environment: %v", err)
+		}
 	}
-
-	for key, value := range cfg.Env {
-		env := fmt.Sprintf("%s=%s", key, value)
+	for _, env := range taskEnvironment(cfg, taskConfig) {
 		c.SetConfigItem("lxc.environment", env)
 	}
 
-	// use task specific config
-	defaultConfig := taskConfig.DefaultConfig
-	if defaultConfig == "" {
-		// but fallback to global config
-		defaultConfig = d.config.DefaultConfig
+	// the default config was saved with the container when it was created
+	if exists {
+		d.logger.Info("Done initializeContainer", "container", hclog.Fmt("%+v", c))
+		return c, nil
 	}
+
+	defaultConfig := d.defaultConfig(taskConfig)
 	err = c.LoadConfigFile(defaultConfig)
 	if err != nil {
 		d.logger.Warn("failed to load default config", "path", defaultConfig, "error", err)
@@ -105,14 +243,43 @@ func (d *Driver) initializeContainer(cfg *drivers.TaskConfig, taskConfig TaskCon
 	return c, nil
 }
 
-func (d *Driver) configureContainerNetwork(c *lxc.Container, taskConfig TaskConfig) error {
+// taskEnvironment returns the environment of the container: the environment
+// of the driver config followed by the task environment
+func taskEnvironment(cfg *drivers.TaskConfig, taskConfig TaskConfig) []string {
+	env := append([]string{}, taskConfig.Environment...)
+
+	taskEnv := make([]string, 0, len(cfg.Env))
+	for key, value := range cfg.Env {
+		taskEnv = append(taskEnv, fmt.Sprintf("%s=%s", key, value))
+	}
+	sort.Strings(taskEnv)
+
+	return append(env, taskEnv...)
+}
+
+// defaultConfig returns the path of the default container config of the task
+func (d *Driver) defaultConfig(taskConfig TaskConfig) string {
+	// use task specific config
+	if taskConfig.DefaultConfig != "" {
+		return taskConfig.DefaultConfig
+	}
+	// but fallback to global config
+	return d.currentConfig().DefaultConfig
+}
 
+// networkMode returns the network mode of the task
+func (d *Driver) networkMode(taskConfig TaskConfig) string {
 	// use task specific network mode
 	mode := taskConfig.NetworkMode
 	if mode == "" {
 		// but fallback to global driver config
-		mode = d.config.NetworkMode
+		mode = d.currentConfig().NetworkMode
 	}
+	return mode
+}
+
+func (d *Driver) configureContainerNetwork(c *lxc.Container, taskConfig TaskConfig) error {
+	mode := d.networkMode(taskConfig)
 
 	// switch lxc < 2.1
 	lxcKeyPrefix := networkTypeConfigPrefix()
@@ -139,6 +306,99 @@ func (d *Driver) configureContainerNetwork(c *lxc.Container, taskConfig TaskConf
 	return nil
 }
 
+// verifyRecoveredContainer checks that the container of a recovered task is
+// still running that task, and returns its init pid. The pid reported by
+// liblxc must be in the container cgroup, and for application containers must
+// not have started after the task did, so that a container recreated or a pid
+// reused while the Nomad client was down is not mistaken for the task.
+func verifyRecoveredContainer(c *lxc.Container, taskConfig TaskConfig, startedAt time.Time) (int, error) {
+	if !c.Defined() {
+		return 0, fmt.Errorf("container %s no longer exists", c.Name())
+	}
+	if !c.Running() {
+		return 0, fmt.Errorf("container %s is no longer running", c.Name())
+	}
+
+	pid := c.InitPid()
+	if pid <= 0 {
+		return 0, fmt.Errorf("container %s has no init process", c.Name())
+	}
+
+	ok, err := pidInContainerCgroup(pid, c.Name(), taskConfig.Cgroup)
+	if err != nil {
+		return 0, fmt.Errorf("failed to look up cgroup of container %s init process: %v", c.Name(), err)
+	}
+	if !ok {
+		return 0, fmt.Errorf("pid %d does not belong to container %s", pid, c.Name())
+	}
+
+	// system containers get a new init process whenever they reboot
+	if taskConfig.BootMode == bootModeSystem || startedAt.IsZero() {
+		return pid, nil
+	}
+
+	pidStart, err := procStartTime(pid)
+	if err != nil {
+		return 0, fmt.Errorf("failed to look up start time of container %s init process: %v", c.Name(), err)
+	}
+	if pidStart.After(startedAt.Add(recoverStartTimeSlack)) {
+		return 0, fmt.Errorf("container %s was restarted after the task started", c.Name())
+	}
+
+	return pid, nil
+}
+
+// configureSystemContainer sets up a container that boots its own init. The
+// halt signal is what the init system expects for a clean poweroff (for
+// systemd, SIGRTMIN+3), and the stop signal is sent when it doesn't halt in
+// time. Resource limits are part of the container config so they are applied
+// before init starts and again whenever the container reboots.
+func (d *Driver) configureSystemContainer(c *lxc.Container, cfg *drivers.TaskConfig, taskConfig TaskConfig) error {
+	haltKey, stopKey := signalConfigKeys()
+
+	if taskConfig.HaltSignal != "" {
+		if err := c.SetConfigItem(haltKey, taskConfig.HaltSignal); err != nil {
+			return fmt.Errorf("error setting halt signal %q: %v", taskConfig.HaltSignal, err)
+		}
+	}
+	if taskConfig.StopSignal != "" {
+		if err := c.SetConfigItem(stopKey, taskConfig.StopSignal); err != nil {
+			return fmt.Errorf("error setting stop signal %q: %v", taskConfig.StopSignal, err)
+		}
+	}
+
+	memory := fmt.Sprintf("%.f", lxc.ByteSize(cfg.Resources.NomadResources.Memory.MemoryMB)*lxc.MB)
+	shares := strconv.FormatInt(cfg.Resources.LinuxResources.CPUShares, 10)
+
+	limits := map[string]string{
+		"lxc.cgroup.memory.limit_in_bytes": memory,
+		"lxc.cgroup.cpu.shares":            shares,
+	}
+	if unifiedCgroupRoot() == cgroupRoot {
+		limits = map[string]string{
+			"lxc.cgroup2.memory.max": memory,
+			"lxc.cgroup2.cpu.weight": shares,
+		}
+	}
+	for k, v := range limits {
+		if err := c.SetConfigItem(k, v); err != nil {
+			return fmt.Errorf("error setting resource limit %s: %v", k, err)
+		}
+	}
+
+	return nil
+}
+
+// signalConfigKeys returns the config keys for the halt and stop signals
+func signalConfigKeys() (string, string) {
+	if lxc.VersionAtLeast(2, 1, 0) {
+		return "lxc.signal.halt", "lxc.signal.stop"
+	}
+
+	// prior to 2.1, signals used
+	return "lxc.haltsignal", "lxc.stopsignal"
+}
+
 func networkTypeConfigPrefix() string {
 	if lxc.VersionAtLeast(2, 1, 0) {
 		return "lxc.net.0."
@@ -148,30 +408,32 @@ func networkTypeConfigPrefix() string {
 	return "lxc.network."
 }
 
-func (d *Driver) mountVolumes(c *lxc.Container, cfg *drivers.TaskConfig, taskConfig TaskConfig) error {
+// mountVolumes sets up the mounts of the container and returns the mount
+// entries applied
+func (d *Driver) mountVolumes(c *lxc.Container, cfg *drivers.TaskConfig, taskConfig TaskConfig) ([]string, error) {
 	mounts, err := d.mountEntries(cfg, taskConfig)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	devCgroupAllows, err := d.devicesCgroupEntries(cfg)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	for _, mnt := range mounts {
 		if err := c.SetConfigItem("lxc.mount.entry", mnt); err != nil {
-			return fmt.Errorf("error setting bind mount %q error: %v", mnt, err)
+			return nil, fmt.Errorf("error setting bind mount %q error: %v", mnt, err)
 		}
 	}
 
 	for _, cgroupDev := range devCgroupAllows {
 		if err := c.SetConfigItem("lxc.cgroup.devices.allow", cgroupDev); err != nil {
-			return fmt.Errorf("error setting cgroup permission %q error: %v", cgroupDev, err)
+			return nil, fmt.Errorf("error setting cgroup permission %q error: %v", cgroupDev, err)
 		}
 	}
 
-	return nil
+	return mounts, nil
 }
 
 // mountEntries compute the mount entries to be set on the container
@@ -186,7 +448,7 @@ func (d *Driver) mountEntries(cfg *drivers.TaskConfig, taskConfig TaskConfig) ([
 	mounts = append(mounts, d.formatTaskMounts(cfg.Mounts)...)
 	mounts = append(mounts, d.formatTaskDevices(cfg.Devices)...)
 
-	volumesEnabled := d.config.AllowVolumes
+	volumesEnabled := d.currentConfig().AllowVolumes
 
 	for _, volDesc := range taskConfig.Volumes {
 		// the format was checked in Validate()
@@ -299,16 +561,84 @@ func (d *Driver) setResourceLimits(c *lxc.Container, cfg *drivers.TaskConfig) er
 	return nil
 }
 
-func toLXCCreateOptions(taskConfig TaskConfig) lxc.TemplateOptions {
-	return lxc.TemplateOptions{
+// toLXCCreateOptions returns the validated liblxc options to create the
+// container rootfs. The image server options are only understood by the
+// download template. Containers created from a rootfs run no template, so
+// their options are empty.
+func toLXCCreateOptions(taskConfig TaskConfig) (lxc.TemplateOptions, error) {
+	if err := validateRootfs(taskConfig); err != nil {
+		return lxc.TemplateOptions{}, err
+	}
+	if taskConfig.Rootfs != "" {
+		// no template runs
+		return lxc.TemplateOptions{}, nil
+	}
+	if taskConfig.Template == "" {
+		return lxc.TemplateOptions{}, fmt.Errorf("lxc driver config requires either 'template' or 'rootfs'")
+	}
+
+	opts := lxc.TemplateOptions{
 		Template:             taskConfig.Template,
 		Distro:               taskConfig.Distro,
 		Release:              taskConfig.Release,
 		Arch:                 taskConfig.Arch,
-		FlushCache:           taskConfig.FlushCache,
+		Variant:              taskConfig.ImageVariant,
+		Server:               taskConfig.ImageServer,
+		KeyID:                taskConfig.GPGKeyID,
+		KeyServer:            taskConfig.GPGKeyServer,
 		DisableGPGValidation: taskConfig.DisableGPGValidation,
+		FlushCache:           taskConfig.FlushCache,
+		ForceCache:           taskConfig.ForceCache,
 		ExtraArgs:            taskConfig.TemplateArgs,
 	}
+
+	if opts.Template == ociTemplate && taskConfig.OCIImage == "" {
+		return opts, fmt.Errorf("lxc driver config 'oci_image' is required by the %s template", ociTemplate)
+	}
+	if opts.Template != ociTemplate && taskConfig.OCIImage != "" {
+		return opts, fmt.Errorf("lxc driver config 'oci_image' is only supported by the %s template", ociTemplate)
+	}
+
+	if opts.Template != "" && opts.Template != downloadTemplate {
+		downloadOnly := []struct {
+			key string
+			set bool
+		}{
+			{"image_variant", opts.Variant != ""},
+			{"image_server", opts.Server != ""},
+			{"gpg_key_id", opts.KeyID != ""},
+			{"gpg_key_server", opts.KeyServer != ""},
+			{"disable_gpg", opts.DisableGPGValidation},
+			{"force_cache", opts.ForceCache},
+		}
+		for _, o := range downloadOnly {
+			if o.set {
+				return opts, fmt.Errorf("lxc driver config '%s' is only supported by the %s template", o.key, downloadTemplate)
+			}
+		}
+		return opts, nil
+	}
+
+	if opts.Distro == "" || opts.Release == "" || opts.Arch == "" {
+		return opts, fmt.Errorf("lxc driver config 'distro', 'release' and 'arch' are required by the %s template", downloadTemplate)
+	}
+	if opts.FlushCache && opts.ForceCache {
+		return opts, fmt.Errorf("lxc driver config 'flush_cache' and 'force_cache' are mutually exclusive")
+	}
+	if opts.DisableGPGValidation && (opts.KeyID != "" || opts.KeyServer != "") {
+		return opts, fmt.Errorf("lxc driver config 'gpg_key_id' and 'gpg_key_server' cannot be set when 'disable_gpg' is true")
+	}
+	if strings.Contains(opts.Server, "/") {
+		return opts, fmt.Errorf("lxc driver config 'image_server' must be a host name, not a URL: %q", opts.Server)
+	}
+	if opts.KeyID != "" && !gpgKeyIDRe.MatchString(opts.KeyID) {
+		return opts, fmt.Errorf("lxc driver config 'gpg_key_id' must be a hexadecimal key ID or fingerprint: %q", opts.KeyID)
+	}
+	if opts.KeyServer != "" && strings.ContainsAny(opts.KeyServer, " \t\n") {
+		return opts, fmt.Errorf("lxc driver config 'gpg_key_server' is not a valid key server: %q", opts.KeyServer)
+	}
+
+	return opts, nil
 }
 
 // waitTillStopped blocks and returns true when container stops;
@@ -1,12 +1,18 @@
 package lxc
 
 import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/hashicorp/nomad/helper/testlog"
 	"github.com/hashicorp/nomad/helper/uuid"
 	"github.com/hashicorp/nomad/nomad/structs"
 	"github.com/hashicorp/nomad/plugins/drivers"
+	lxc "github.com/lxc/go-lxc"
 	"github.com/stretchr/testify/require"
 )
 
@@ -119,3 +125,336 @@ func TestLXCDriver_DevicesCgroup(t *testing.T) {
 	}
 	require.EqualValues(t, expected, cgroupEntries)
 }
+
+func TestLXCDriver_ParseOOMKillCount(t *testing.T) {
+	t.Parallel()
+
+	// cgroup v2 memory.events
+	n, err := parseOOMKillCount("low 0\nhigh 0\nmax 12\noom 2\noom_kill 1\n")
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), n)
+
+	// cgroup v1 memory.oom_control
+	n, err = parseOOMKillCount("oom_kill_disable 0\nunder_oom 0\noom_kill 0\n")
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), n)
+
+	// kernels older than 4.13 don't report the counter
+	_, err = parseOOMKillCount("oom_kill_disable 0\nunder_oom 0\n")
+	require.Error(t, err)
+}
+
+func TestLXCDriver_RestartMode(t *testing.T) {
+	t.Parallel()
+
+	mode, err := restartMode(TaskConfig{})
+	require.NoError(t, err)
+	require.Equal(t, restartModeRecreate, mode)
+
+	mode, err = restartMode(TaskConfig{RestartMode: "reuse"})
+	require.NoError(t, err)
+	require.Equal(t, restartModeReuse, mode)
+
+	_, err = restartMode(TaskConfig{RestartMode: "restart"})
+	require.EqualError(t, err, "lxc driver config 'restart_mode' can only be either recreate or reuse")
+}
+
+func TestLXCDriver_BootMode(t *testing.T) {
+	t.Parallel()
+
+	mode, err := bootMode(TaskConfig{Command: []string{"/bin/sleep", "10"}})
+	require.NoError(t, err)
+	require.Equal(t, bootModeCommand, mode)
+
+	mode, err = bootMode(TaskConfig{BootMode: "system"})
+	require.NoError(t, err)
+	require.Equal(t, bootModeSystem, mode)
+
+	_, err = bootMode(TaskConfig{BootMode: "system", Command: []string{"/bin/sh"}})
+	require.EqualError(t, err, "lxc driver config 'command' cannot be set when 'boot_mode' is system")
+
+	_, err = bootMode(TaskConfig{BootMode: "init"})
+	require.EqualError(t, err, "lxc driver config 'boot_mode' can only be either command or system")
+}
+
+func TestLXCDriver_ParseProcStatStartTime(t *testing.T) {
+	t.Parallel()
+
+	// the command name may contain spaces and parentheses
+	stat := "4242 (lxc (init)) S 4241 4242 4242 0 -1 4194560 1041 0 0 0 1 2 0 0 20 0 1 0 98765 4333568 250 18446744073709551615"
+	ticks, err := parseProcStatStartTime(stat)
+	require.NoError(t, err)
+	require.Equal(t, uint64(98765), ticks)
+
+	_, err = parseProcStatStartTime("4242 (init) S 1")
+	require.Error(t, err)
+}
+
+func TestLXCDriver_OrphansDue(t *testing.T) {
+	t.Parallel()
+
+	orphan := "web-" + uuid.Generate()
+	running := "api-" + uuid.Generate()
+	names := []string{orphan, running, "handmade"}
+	referenced := map[string]struct{}{running: {}}
+
+	r := newOrphanReaper()
+	now := time.Now()
+
+	due, found := r.orphansDue(names, referenced, now, time.Hour)
+	require.Empty(t, due)
+	require.Equal(t, []string{orphan}, found)
+
+	due, found = r.orphansDue(names, referenced, now.Add(time.Hour), time.Hour)
+	require.Equal(t, []string{orphan}, due)
+	require.Empty(t, found)
+	require.Equal(t, uint64(1), r.found)
+
+	// orphans that disappear are forgotten
+	_, _ = r.orphansDue(names[1:], referenced, now.Add(2*time.Hour), time.Hour)
+	require.Empty(t, r.firstSeen)
+}
+
+func TestLXCDriver_ReusedDue(t *testing.T) {
+	t.Parallel()
+
+	lxcPath, err := ioutil.TempDir("", "lxc-reused")
+	require.NoError(t, err)
+	defer os.RemoveAll(lxcPath)
+
+	allocDir := filepath.Join(lxcPath, "alloc")
+	require.NoError(t, os.MkdirAll(allocDir, 0755))
+
+	reused := "web-" + uuid.Generate()
+	restarting := "api-" + uuid.Generate()
+	recreated := "db-" + uuid.Generate()
+	for _, name := range []string{reused, restarting, recreated} {
+		require.NoError(t, os.MkdirAll(filepath.Join(lxcPath, name), 0755))
+	}
+	for _, name := range []string{reused, restarting} {
+		buf, err := json.Marshal(&reusedContainer{AllocDir: allocDir})
+		require.NoError(t, err)
+		require.NoError(t, ioutil.WriteFile(filepath.Join(lxcPath, name, reuseFile), buf, 0644))
+	}
+
+	names := []string{reused, restarting, recreated}
+	referenced := map[string]struct{}{restarting: {}}
+
+	// the allocation may still run the task again
+	require.Empty(t, reusedDue(lxcPath, names, referenced))
+
+	// once the allocation is gone, only running tasks keep their container
+	require.NoError(t, os.RemoveAll(allocDir))
+	require.Equal(t, []string{reused}, reusedDue(lxcPath, names, referenced))
+}
+
+func TestLXCDriver_RetentionDue(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	retained := []*retainedContainer{
+		{Name: "a1", Job: "a", StoppedAt: now.Add(-3 * time.Hour), Size: 10},
+		{Name: "a2", Job: "a", Failed: true, StoppedAt: now.Add(-2 * time.Hour), Size: 10},
+		{Name: "a3", Job: "a", StoppedAt: now.Add(-1 * time.Hour), Size: 10},
+		{Name: "b1", Job: "b", Failed: true, StoppedAt: now.Add(-30 * time.Minute), Size: 10},
+	}
+
+	// the newest container of each job, and failed ones for 4h
+	p := retainPolicy{keepFailed: 4 * time.Hour, keepLast: 1}
+	require.ElementsMatch(t, []string{"a1"}, retentionDue(retained, p, now))
+
+	// failed ones for 1h only
+	p.keepFailed = time.Hour
+	require.ElementsMatch(t, []string{"a1", "a2"}, retentionDue(retained, p, now))
+
+	// the disk cap evicts the oldest kept containers first
+	p = retainPolicy{keepLast: 3, maxDisk: 20}
+	require.ElementsMatch(t, []string{"a1", "a2"}, retentionDue(retained, p, now))
+}
+
+func TestLXCDriver_LoadRetainedContainers(t *testing.T) {
+	t.Parallel()
+
+	lxcPath, err := ioutil.TempDir("", "lxc-retained")
+	require.NoError(t, err)
+	defer os.RemoveAll(lxcPath)
+
+	rootfs := filepath.Join(lxcPath, "a1", "rootfs")
+	require.NoError(t, os.MkdirAll(rootfs, 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(rootfs, "data"), []byte("12345"), 0644))
+	require.NoError(t, writeRetention(lxcPath, &retainedContainer{Name: "a1", Job: "a"}))
+
+	// records without a size are measured once
+	retained := loadRetainedContainers(lxcPath, []string{"a1", "a2"}, true)
+	require.Len(t, retained, 1)
+	require.Equal(t, "a1", retained[0].Name)
+	size := retained[0].Size
+	require.True(t, size >= 5)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(rootfs, "more"), []byte("67890"), 0644))
+	retained = loadRetainedContainers(lxcPath, []string{"a1"}, true)
+	require.Equal(t, size, retained[0].Size)
+}
+
+func TestLXCDriver_CreateOptions(t *testing.T) {
+	t.Parallel()
+
+	taskConfig := TaskConfig{
+		Template:     "download",
+		Distro:       "alpine",
+		Release:      "3.15",
+		Arch:         "amd64",
+		ImageVariant: "cloud",
+		ImageServer:  "images.example.com",
+		GPGKeyID:     "0x0E9C5D3A4F2C9B8E",
+		GPGKeyServer: "hkp://keys.example.com",
+		ForceCache:   true,
+		TemplateArgs: []string{"--no-validate"},
+	}
+
+	opts, err := toLXCCreateOptions(taskConfig)
+	require.NoError(t, err)
+	require.Equal(t, lxc.TemplateOptions{
+		Template:   "download",
+		Distro:     "alpine",
+		Release:    "3.15",
+		Arch:       "amd64",
+		Variant:    "cloud",
+		Server:     "images.example.com",
+		KeyID:      "0x0E9C5D3A4F2C9B8E",
+		KeyServer:  "hkp://keys.example.com",
+		ForceCache: true,
+		ExtraArgs:  []string{"--no-validate"},
+	}, opts)
+
+	bad := taskConfig
+	bad.FlushCache = true
+	_, err = toLXCCreateOptions(bad)
+	require.EqualError(t, err, "lxc driver config 'flush_cache' and 'force_cache' are mutually exclusive")
+
+	bad = taskConfig
+	bad.DisableGPGValidation = true
+	_, err = toLXCCreateOptions(bad)
+	require.EqualError(t, err, "lxc driver config 'gpg_key_id' and 'gpg_key_server' cannot be set when 'disable_gpg' is true")
+
+	bad = taskConfig
+	bad.ImageServer = "https://images.example.com"
+	_, err = toLXCCreateOptions(bad)
+	require.EqualError(t, err, `lxc driver config 'image_server' must be a host name, not a URL: "https://images.example.com"`)
+
+	bad = taskConfig
+	bad.GPGKeyID = "linuxcontainers"
+	_, err = toLXCCreateOptions(bad)
+	require.Error(t, err)
+
+	bad = taskConfig
+	bad.Arch = ""
+	_, err = toLXCCreateOptions(bad)
+	require.EqualError(t, err, "lxc driver config 'distro', 'release' and 'arch' are required by the download template")
+
+	// image server options are rejected by other templates
+	_, err = toLXCCreateOptions(TaskConfig{Template: "busybox", ImageServer: "images.example.com"})
+	require.EqualError(t, err, "lxc driver config 'image_server' is only supported by the download template")
+
+	opts, err = toLXCCreateOptions(TaskConfig{Template: "busybox", FlushCache: true})
+	require.NoError(t, err)
+	require.Equal(t, lxc.TemplateOptions{Template: "busybox", FlushCache: true}, opts)
+}
+
+func TestLXCDriver_BaseContainerName(t *testing.T) {
+	t.Parallel()
+
+	opts := lxc.TemplateOptions{Template: "download", Distro: "alpine", Release: "3.15", Arch: "amd64"}
+	name := baseContainerName(opts, "/etc/lxc/default.conf", "overlay")
+	require.Regexp(t, `^nomad-base-alpine-3\.15-amd64-[0-9a-f]{12}$`, name)
+	require.False(t, taskContainerNameRe.MatchString(name))
+
+	// identically created containers share the base
+	require.Equal(t, name, baseContainerName(opts, "/etc/lxc/default.conf", "overlay"))
+
+	// anything shaping the container gets its own base
+	require.NotEqual(t, name, baseContainerName(opts, "/etc/lxc/other.conf", "overlay"))
+	require.NotEqual(t, name, baseContainerName(opts, "/etc/lxc/default.conf", "btrfs"))
+	opts.Variant = "cloud"
+	require.NotEqual(t, name, baseContainerName(opts, "/etc/lxc/default.conf", "overlay"))
+
+	name = baseContainerName(lxc.TemplateOptions{Template: "/usr/share/lxc/templates/lxc-busybox"}, "", "zfs")
+	require.Regexp(t, `^nomad-base-lxc-busybox-[0-9a-f]{12}$`, name)
+}
+
+func TestLXCDriver_CloneConfig(t *testing.T) {
+	t.Parallel()
+
+	require.NoError(t, (&CloneConfig{Backend: "loop"}).validate())
+
+	c := &CloneConfig{Enabled: true, Backend: "overlay"}
+	require.NoError(t, c.validate())
+	require.Equal(t, lxc.Directory, c.baseBackend())
+
+	c.Backend = "btrfs"
+	require.NoError(t, c.validate())
+	require.Equal(t, lxc.Btrfs, c.baseBackend())
+
+	c.Backend = "dir"
+	require.EqualError(t, c.validate(), "clone.backend can only be one of overlay, btrfs, zfs or lvm")
+}
+
+func TestLXCDriver_BackingStore(t *testing.T) {
+	t.Parallel()
+
+	c := &BackingStoreConfig{
+		Allowed:  []string{"dir", "lvm", "zfs"},
+		FSType:   "ext4",
+		FSSizeMB: 1024,
+		ZFSRoot:  "tank/lxc",
+		LVMVG:    "nomad",
+	}
+	require.NoError(t, c.validate())
+	require.Equal(t, "dir", c.Default)
+
+	name, backend, _, err := c.resolve(TaskConfig{})
+	require.NoError(t, err)
+	require.Equal(t, "dir", name)
+	require.Equal(t, lxc.Directory, backend)
+
+	name, backend, specs, err := c.resolve(TaskConfig{BackingStore: "lvm", BackingStoreFSType: "xfs"})
+	require.NoError(t, err)
+	require.Equal(t, "lvm", name)
+	require.Equal(t, lxc.LVM, backend)
+	require.Equal(t, "xfs", specs.FSType)
+	require.Equal(t, uint64(1024*1024*1024), specs.FSSize)
+	require.Equal(t, "nomad", specs.LVM.VG)
+	require.Equal(t, "tank/lxc", specs.ZFS.Root)
+
+	_, _, _, err = c.resolve(TaskConfig{BackingStore: "btrfs"})
+	require.EqualError(t, err, `lxc driver config 'backingstore' "btrfs" is not allowed on this node, allowed backing stores are dir, lvm, zfs`)
+
+	_, _, _, err = c.resolve(TaskConfig{BackingStore: "tmpfs"})
+	require.EqualError(t, err, "lxc driver config 'backingstore' can only be one of btrfs, dir, loop, lvm, overlay, zfs")
+
+	_, _, _, err = c.resolve(TaskConfig{BackingStore: "zfs", BackingStoreSizeMB: 512})
+	require.EqualError(t, err, "lxc driver config 'backingstore_fstype' and 'backingstore_size_mb' are only supported by the lvm and loop backing stores")
+
+	c = &BackingStoreConfig{Default: "btrfs", Allowed: []string{"dir"}}
+	require.EqualError(t, c.validate(), `backingstore.default "btrfs" is not in backingstore.allowed`)
+}
+
+func TestLXCDriver_RootfsBackingStore(t *testing.T) {
+	t.Parallel()
+
+	cases := map[string]string{
+		"dir:/var/lib/lxc/c1/rootfs":                                "dir",
+		"/var/lib/lxc/c1/rootfs":                                    "dir",
+		"overlay:/var/lib/lxc/base/rootfs:/var/lib/lxc/c1/delta0":   "overlay",
+		"overlayfs:/var/lib/lxc/base/rootfs:/var/lib/lxc/c1/delta0": "overlay",
+		"btrfs:/var/lib/lxc/c1/rootfs":                              "btrfs",
+		"zfs:tank/lxc/c1":                                           "zfs",
+		"lvm:/dev/nomad/c1":                                         "lvm",
+		"/dev/nomad/c1":                                             "lvm",
+		"loop:/var/lib/lxc/c1/rootdev":                              "loop",
+	}
+	for path, expected := range cases {
+		require.Equal(t, expected, rootfsBackingStore([]string{path}), path)
+	}
+	require.Empty(t, rootfsBackingStore(nil))
+}
@@ -0,0 +1,239 @@
+package lxc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The lxc monitor is how liblxc reports container state transitions and the
+// exit status of a container's init process. A container's monitor process
+// writes messages to a fifo under the lxc rundir, and lxc-monitord forwards
+// them to every client connected to its abstract unix socket.
+//
+// The constants and message layout below mirror lxc/monitor.h.
+const (
+	lxcMsgState    = 0
+	lxcMsgPriority = 1
+	lxcMsgExitCode = 2
+
+	// lxcMsgNameLen is NAME_MAX+1, the size of lxc_msg.name
+	lxcMsgNameLen = 256
+
+	// lxcMsgSize is the size of struct lxc_msg: int type, char name[], int value
+	lxcMsgSize = 4 + lxcMsgNameLen + 4
+
+	// lxcMonitorSockPathMax is the length liblxc truncates the abstract
+	// socket name to, including the leading NUL byte (written as @) and
+	// leaving room for the trailing one in sun_path
+	lxcMonitorSockPathMax = 106
+
+	// monitordStartTimeout is how long to wait for a spawned lxc-monitord to
+	// report that it is listening
+	monitordStartTimeout = 5 * time.Second
+)
+
+// monitordSearchPaths are the locations where distributions install
+// lxc-monitord; it is not normally on PATH
+var monitordSearchPaths = []string{
+	"/usr/libexec/lxc/lxc-monitord",
+	"/usr/lib/lxc/lxc-monitord",
+	"/usr/local/libexec/lxc/lxc-monitord",
+	"/usr/lib/*/lxc/lxc-monitord",
+}
+
+// lxcMsg is a decoded struct lxc_msg
+type lxcMsg struct {
+	Type  int32
+	Name  string
+	Value int32
+}
+
+// lxcMonitorSockName returns the abstract socket name lxc-monitord listens on
+// for the given lxc path, matching lxc_monitor_sock_name in liblxc.
+func lxcMonitorSockName(lxcPath string) string {
+	h := fnv.New64a()
+	h.Write([]byte(fmt.Sprintf("lxc/%s/monitor-sock", lxcPath)))
+
+	// liblxc formats the name with the @ prefix before truncating it
+	name := fmt.Sprintf("@lxc/%016x/%s", h.Sum64(), lxcPath)
+	if len(name) > lxcMonitorSockPathMax {
+		name = name[:lxcMonitorSockPathMax]
+	}
+	return name
+}
+
+// decodeLXCMsg decodes a raw struct lxc_msg. liblxc writes the message in host
+// byte order; all platforms this driver is built for are little endian.
+func decodeLXCMsg(buf []byte) lxcMsg {
+	name := buf[4 : 4+lxcMsgNameLen]
+	if i := bytes.IndexByte(name, 0); i >= 0 {
+		name = name[:i]
+	}
+
+	return lxcMsg{
+		Type:  int32(binary.LittleEndian.Uint32(buf[0:4])),
+		Name:  string(name),
+		Value: int32(binary.LittleEndian.Uint32(buf[4+lxcMsgNameLen:])),
+	}
+}
+
+// dialLXCMonitor connects to lxc-monitord for lxcPath, spawning the daemon if
+// it is not already running.
+func dialLXCMonitor(lxcPath string) (net.Conn, error) {
+	addr := lxcMonitorSockName(lxcPath)
+	conn, err := net.Dial("unix", addr)
+	if err == nil {
+		return conn, nil
+	}
+
+	if err := spawnLXCMonitord(lxcPath); err != nil {
+		return nil, err
+	}
+
+	return net.Dial("unix", addr)
+}
+
+// spawnLXCMonitord starts lxc-monitord for lxcPath and waits until it is
+// ready to accept clients. The daemon exits on its own once it has had no
+// clients for a while.
+func spawnLXCMonitord(lxcPath string) error {
+	bin, err := findLXCMonitord()
+	if err != nil {
+		return err
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("failed to create lxc-monitord pipe: %v", err)
+	}
+	defer r.Close()
+
+	// the write end becomes fd 3 in the child
+	cmd := exec.Command(bin, lxcPath, "3")
+	cmd.ExtraFiles = []*os.File{w}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		w.Close()
+		return fmt.Errorf("failed to start lxc-monitord: %v", err)
+	}
+	w.Close()
+	go cmd.Wait()
+
+	// lxc-monitord writes a byte and closes the pipe once it is listening
+	r.SetReadDeadline(time.Now().Add(monitordStartTimeout))
+	if _, err := r.Read(make([]byte, 1)); err != nil && err != io.EOF {
+		return fmt.Errorf("lxc-monitord failed to start: %v", err)
+	}
+
+	return nil
+}
+
+func findLXCMonitord() (string, error) {
+	if p, err := exec.LookPath("lxc-monitord"); err == nil {
+		return p, nil
+	}
+
+	for _, pattern := range monitordSearchPaths {
+		matches, _ := filepath.Glob(pattern)
+		if len(matches) > 0 {
+			return matches[0], nil
+		}
+	}
+
+	return "", fmt.Errorf("lxc-monitord not found")
+}
+
+// exitMonitor listens on the lxc monitor for the exit status of a single
+// container's init process.
+type exitMonitor struct {
+	conn net.Conn
+	name string
+
+	// done is closed once the exit status is known or the monitor failed
+	done     chan struct{}
+	doneOnce sync.Once
+
+	status syscall.WaitStatus
+	err    error
+}
+
+// newExitMonitor subscribes to the lxc monitor for the container name. It must
+// be called before the container is started, as lxc-monitord does not replay
+// messages sent before a client connected.
+func newExitMonitor(lxcPath, name string) (*exitMonitor, error) {
+	conn, err := dialLXCMonitor(lxcPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to lxc monitor: %v", err)
+	}
+
+	m := &exitMonitor{
+		conn: conn,
+		name: name,
+		done: make(chan struct{}),
+	}
+	go m.run()
+	return m, nil
+}
+
+func (m *exitMonitor) run() {
+	buf := make([]byte, lxcMsgSize)
+	for {
+		if _, err := io.ReadFull(m.conn, buf); err != nil {
+			m.finish(0, fmt.Errorf("lxc monitor closed before container exited: %v", err))
+			return
+		}
+
+		msg := decodeLXCMsg(buf)
+		if msg.Type == lxcMsgExitCode && msg.Name == m.name {
+			m.finish(syscall.WaitStatus(msg.Value), nil)
+			return
+		}
+	}
+}
+
+func (m *exitMonitor) finish(status syscall.WaitStatus, err error) {
+	m.doneOnce.Do(func() {
+		m.status = status
+		m.err = err
+		close(m.done)
+	})
+	m.conn.Close()
+}
+
+// wait blocks until the exit status of the container is received or timeout
+// elapses.
+func (m *exitMonitor) wait(timeout time.Duration) (syscall.WaitStatus, error) {
+	select {
+	case <-m.done:
+		return m.status, m.err
+	case <-time.After(timeout):
+		m.close()
+		return 0, fmt.Errorf("timed out waiting for container exit status")
+	}
+}
+
+// close releases the monitor connection
+func (m *exitMonitor) close() {
+	m.finish(0, fmt.Errorf("exit monitor closed"))
+}
+
+// exitCodeFromStatus converts the wait status of the container init process
+// into the exit code and signal reported to nomad. Like nomad's executor, a
+// process killed by a signal reports 128+signal as its exit code.
+func exitCodeFromStatus(status syscall.WaitStatus) (int, int) {
+	if status.Signaled() {
+		sig := int(status.Signal())
+		return 128 + sig, sig
+	}
+	return status.ExitStatus(), 0
+}
@@ -0,0 +1,52 @@
+package lxc
+
+import (
+	"encoding/binary"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLXCMonitor_DecodeMsg(t *testing.T) {
+	t.Parallel()
+
+	buf := make([]byte, lxcMsgSize)
+	binary.LittleEndian.PutUint32(buf[0:4], lxcMsgExitCode)
+	copy(buf[4:], "web-1234")
+	binary.LittleEndian.PutUint32(buf[4+lxcMsgNameLen:], 3<<8)
+
+	msg := decodeLXCMsg(buf)
+	require.Equal(t, int32(lxcMsgExitCode), msg.Type)
+	require.Equal(t, "web-1234", msg.Name)
+
+	code, sig := exitCodeFromStatus(syscall.WaitStatus(msg.Value))
+	require.Equal(t, 3, code)
+	require.Equal(t, 0, sig)
+}
+
+func TestLXCMonitor_ExitCodeFromStatus(t *testing.T) {
+	t.Parallel()
+
+	code, sig := exitCodeFromStatus(syscall.WaitStatus(0))
+	require.Equal(t, 0, code)
+	require.Equal(t, 0, sig)
+
+	// terminated by SIGKILL
+	code, sig = exitCodeFromStatus(syscall.WaitStatus(9))
+	require.Equal(t, 137, code)
+	require.Equal(t, 9, sig)
+}
+
+func TestLXCMonitor_SockName(t *testing.T) {
+	t.Parallel()
+
+	name := lxcMonitorSockName("/var/lib/lxc")
+	require.True(t, strings.HasPrefix(name, "@lxc/"))
+	require.True(t, strings.HasSuffix(name, "//var/lib/lxc"))
+
+	long := lxcMonitorSockName("/" + strings.Repeat("a", 200))
+	require.Len(t, long, lxcMonitorSockPathMax)
+	require.True(t, strings.HasPrefix(long, "@lxc/"))
+}
@@ -0,0 +1,232 @@
+package lxc
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+	lxc "github.com/lxc/go-lxc"
+)
+
+const (
+	// ociTemplate is the liblxc template that unpacks OCI images
+	ociTemplate = "oci"
+
+	ociMediaTypeIndex    = "application/vnd.oci.image.index.v1+json"
+	ociMediaTypeManifest = "application/vnd.oci.image.manifest.v1+json"
+
+	// ociRefNameAnnotation tags manifests in the index of an image layout
+	ociRefNameAnnotation = "org.opencontainers.image.ref.name"
+)
+
+// ociDescriptor is a content descriptor of an OCI image layout
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *struct {
+		Architecture string `json:"architecture"`
+		OS           string `json:"os"`
+	} `json:"platform,omitempty"`
+}
+
+// ociImageConfig is the part of the image config that defines how to run the
+// image
+type ociImageConfig struct {
+	Entrypoint []string `json:"Entrypoint"`
+	Cmd        []string `json:"Cmd"`
+	Env        []string `json:"Env"`
+	WorkingDir string   `json:"WorkingDir"`
+}
+
+// command returns the command the image runs by default
+func (c *ociImageConfig) command() []string {
+	return append(append([]string{}, c.Entrypoint...), c.Cmd...)
+}
+
+// ociImage is an OCI image layout referenced by a task
+type ociImage struct {
+	// dir is the host path of the image layout
+	dir string
+
+	// ref is the tag of the image in the layout; it may be empty if the
+	// layout holds a single image
+	ref string
+
+	config *ociImageConfig
+}
+
+// url returns the image url passed to the oci template
+func (i *ociImage) url() string {
+	if i.ref == "" {
+		return "oci:" + i.dir
+	}
+	return fmt.Sprintf("oci:%s:%s", i.dir, i.ref)
+}
+
+// splitOCIImage splits the oci_image of a task config into the path of the
+// layout and its tag. Tags can't contain '/', so a path with a ':' in one of
+// its directories has no tag.
+func splitOCIImage(image string) (string, string) {
+	i := strings.LastIndex(image, ":")
+	if i < 0 || strings.Contains(image[i+1:], "/") {
+		return image, ""
+	}
+	return image[:i], image[i+1:]
+}
+
+// ociImage resolves the OCI image layout of the task and reads its config.
+// Relative layout paths are relative to the task directory, as for volumes.
+func (d *Driver) ociImage(cfg *drivers.TaskConfig, taskConfig TaskConfig) (*ociImage, error) {
+	dir, ref := splitOCIImage(taskConfig.OCIImage)
+	if dir == "" {
+		return nil, fmt.Errorf("lxc driver config 'oci_image' must be the path of an OCI image layout")
+	}
+
+	if filepath.IsAbs(dir) {
+		if !d.currentConfig().AllowVolumes {
+			return nil, fmt.Errorf("absolute 'oci_image' path in config but volumes are disabled")
+		}
+	} else {
+		dir = filepath.Join(cfg.TaskDir().Dir, dir)
+		if !d.currentConfig().AllowVolumes && pathEscapesSandbox(cfg.TaskDir().Dir, dir) {
+			return nil, fmt.Errorf("'oci_image' path escapes task directory but volumes are disabled")
+		}
+	}
+
+	config, err := readOCIImageConfig(dir, ref)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read OCI image %q: %v", taskConfig.OCIImage, err)
+	}
+	return &ociImage{dir: dir, ref: ref, config: config}, nil
+}
+
+// readOCIImageConfig reads the config of the image tagged ref in the image
+// layout at dir. Multi-platform images resolve to the linux image of the
+// host architecture.
+func readOCIImageConfig(dir, ref string) (*ociImageConfig, error) {
+	var index struct {
+		Manifests []ociDescriptor `json:"manifests"`
+	}
+	if err := readOCIJSON(filepath.Join(dir, "index.json"), &index); err != nil {
+		return nil, err
+	}
+
+	var desc *ociDescriptor
+	for i, m := range index.Manifests {
+		if ref == "" || m.Annotations[ociRefNameAnnotation] == ref {
+			if desc != nil {
+				return nil, fmt.Errorf("the image layout holds several images, a tag is required")
+			}
+			desc = &index.Manifests[i]
+		}
+	}
+	if desc == nil {
+		return nil, fmt.Errorf("no image tagged %q in the image layout", ref)
+	}
+
+	if desc.MediaType == ociMediaTypeIndex {
+		var err error
+		if desc, err = ociPlatformManifest(dir, desc); err != nil {
+			return nil, err
+		}
+	}
+	if desc.MediaType != ociMediaTypeManifest {
+		return nil, fmt.Errorf("unsupported manifest media type %q", desc.MediaType)
+	}
+
+	var manifest struct {
+		Config ociDescriptor `json:"config"`
+	}
+	if err := readOCIBlob(dir, desc.Digest, &manifest); err != nil {
+		return nil, err
+	}
+
+	var image struct {
+		Config ociImageConfig `json:"config"`
+	}
+	if err := readOCIBlob(dir, manifest.Config.Digest, &image); err != nil {
+		return nil, err
+	}
+	return &image.Config, nil
+}
+
+// ociPlatformManifest returns the manifest for the host platform from the
+// image index desc
+func ociPlatformManifest(dir string, desc *ociDescriptor) (*ociDescriptor, error) {
+	var index struct {
+		Manifests []ociDescriptor `json:"manifests"`
+	}
+	if err := readOCIBlob(dir, desc.Digest, &index); err != nil {
+		return nil, err
+	}
+
+	for i, m := range index.Manifests {
+		if m.Platform != nil && m.Platform.OS == "linux" && m.Platform.Architecture == runtime.GOARCH {
+			return &index.Manifests[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no image for linux/%s in the image index", runtime.GOARCH)
+}
+
+// readOCIBlob decodes the JSON blob with the given digest of the image layout
+func readOCIBlob(dir, digest string, v interface{}) error {
+	parts := strings.SplitN(digest, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" || strings.ContainsAny(digest, `/\`) {
+		return fmt.Errorf("invalid digest %q", digest)
+	}
+	return readOCIJSON(filepath.Join(dir, "blobs", parts[0], parts[1]), v)
+}
+
+func readOCIJSON(path string, v interface{}) error {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(buf, v); err != nil {
+		return fmt.Errorf("failed to decode %s: %v", filepath.Base(path), err)
+	}
+	return nil
+}
+
+// mergeEnv returns the variables of env overridden by those of overrides,
+// keeping the order in which variables are first defined
+func mergeEnv(env, overrides []string) []string {
+	merged := make([]string, 0, len(env)+len(overrides))
+	index := map[string]int{}
+	for _, kv := range append(append([]string{}, env...), overrides...) {
+		key := strings.SplitN(kv, "=", 2)[0]
+		if i, ok := index[key]; ok {
+			merged[i] = kv
+			continue
+		}
+		index[key] = len(merged)
+		merged = append(merged, kv)
+	}
+	return merged
+}
+
+// applyOCIImageConfig configures the container created from img to run with
+// the environment and working directory of the image. The environment of the
+// task overrides the image environment.
+func applyOCIImageConfig(c *lxc.Container, img *ociImage, taskEnv []string) error {
+	if err := c.ClearConfigItem("lxc.environment"); err != nil {
+		return fmt.Errorf("failed to clear container environment: %v", err)
+	}
+	for _, env := range mergeEnv(img.config.Env, taskEnv) {
+		if err := c.SetConfigItem("lxc.environment", env); err != nil {
+			return fmt.Errorf("failed to set container environment: %v", err)
+		}
+	}
+
+	if img.config.WorkingDir != "" {
+		if err := c.SetConfigItem("lxc.init.cwd", img.config.WorkingDir); err != nil {
+			return fmt.Errorf("failed to set container working directory: %v", err)
+		}
+	}
+	return nil
+}
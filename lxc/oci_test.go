@@ -0,0 +1,127 @@
+package lxc
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// writeOCIBlob writes v as a JSON blob of the image layout at dir and returns
+// its digest
+func writeOCIBlob(t *testing.T, dir string, v interface{}) string {
+	buf, err := json.Marshal(v)
+	require.NoError(t, err)
+
+	sum := sha256.Sum256(buf)
+	hexSum := hex.EncodeToString(sum[:])
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "blobs", "sha256"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "blobs", "sha256", hexSum), buf, 0644))
+	return "sha256:" + hexSum
+}
+
+func TestLXCDriver_ReadOCIImageConfig(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "lxc-oci")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	manifest := func(entrypoint string) string {
+		config := writeOCIBlob(t, dir, map[string]interface{}{
+			"architecture": runtime.GOARCH,
+			"os":           "linux",
+			"config": map[string]interface{}{
+				"Entrypoint": []string{entrypoint},
+				"Cmd":        []string{"--port", "8080"},
+				"Env":        []string{"PATH=/usr/bin:/bin", "MODE=prod"},
+				"WorkingDir": "/srv",
+			},
+		})
+		return writeOCIBlob(t, dir, map[string]interface{}{
+			"schemaVersion": 2,
+			"mediaType":     ociMediaTypeManifest,
+			"config":        map[string]string{"mediaType": "application/vnd.oci.image.config.v1+json", "digest": config},
+		})
+	}
+
+	// a multi-platform image for v1, and a single platform one for v2
+	v1 := writeOCIBlob(t, dir, map[string]interface{}{
+		"schemaVersion": 2,
+		"manifests": []map[string]interface{}{
+			{"mediaType": ociMediaTypeManifest, "digest": manifest("/bin/other"), "platform": map[string]string{"architecture": "s390x", "os": "linux"}},
+			{"mediaType": ociMediaTypeManifest, "digest": manifest("/bin/server"), "platform": map[string]string{"architecture": runtime.GOARCH, "os": "linux"}},
+		},
+	})
+	buf, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"manifests": []map[string]interface{}{
+			{"mediaType": ociMediaTypeIndex, "digest": v1, "annotations": map[string]string{ociRefNameAnnotation: "v1"}},
+			{"mediaType": ociMediaTypeManifest, "digest": manifest("/bin/server2"), "annotations": map[string]string{ociRefNameAnnotation: "v2"}},
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "index.json"), buf, 0644))
+
+	config, err := readOCIImageConfig(dir, "v1")
+	require.NoError(t, err)
+	require.Equal(t, []string{"/bin/server", "--port", "8080"}, config.command())
+	require.Equal(t, "/srv", config.WorkingDir)
+
+	config, err = readOCIImageConfig(dir, "v2")
+	require.NoError(t, err)
+	require.Equal(t, []string{"/bin/server2", "--port", "8080"}, config.command())
+
+	_, err = readOCIImageConfig(dir, "v3")
+	require.EqualError(t, err, `no image tagged "v3" in the image layout`)
+
+	_, err = readOCIImageConfig(dir, "")
+	require.EqualError(t, err, "the image layout holds several images, a tag is required")
+}
+
+func TestLXCDriver_MergeEnv(t *testing.T) {
+	t.Parallel()
+
+	env := mergeEnv([]string{"PATH=/usr/bin:/bin", "MODE=prod"}, []string{"MODE=dev", "DEBUG=1"})
+	require.Equal(t, []string{"PATH=/usr/bin:/bin", "MODE=dev", "DEBUG=1"}, env)
+}
+
+func TestLXCDriver_SplitOCIImage(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		image string
+		dir   string
+		ref   string
+	}{
+		{"local/image", "local/image", ""},
+		{"local/image:v1", "local/image", "v1"},
+		{"/srv/images:2021/app", "/srv/images:2021/app", ""},
+		{"/srv/images:2021/app:v1", "/srv/images:2021/app", "v1"},
+		{"local/image:", "local/image", ""},
+	}
+	for _, c := range cases {
+		dir, ref := splitOCIImage(c.image)
+		require.Equal(t, c.dir, dir, c.image)
+		require.Equal(t, c.ref, ref, c.image)
+	}
+}
+
+func TestLXCDriver_OCICreateOptions(t *testing.T) {
+	t.Parallel()
+
+	_, err := toLXCCreateOptions(TaskConfig{Template: "oci", OCIImage: "local/image:v1"})
+	require.NoError(t, err)
+
+	_, err = toLXCCreateOptions(TaskConfig{Template: "oci"})
+	require.EqualError(t, err, "lxc driver config 'oci_image' is required by the oci template")
+
+	_, err = toLXCCreateOptions(TaskConfig{Template: "busybox", OCIImage: "local/image:v1"})
+	require.EqualError(t, err, "lxc driver config 'oci_image' is only supported by the oci template")
+}
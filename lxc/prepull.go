@@ -0,0 +1,197 @@
+package lxc
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	pstructs "github.com/hashicorp/nomad/plugins/shared/structs"
+	lxc "github.com/lxc/go-lxc"
+)
+
+const (
+	// defaultDownloadCacheDir is the cache directory of the download template
+	// when run as root, unless LXC_CACHE_PATH is set
+	defaultDownloadCacheDir = "/var/cache/lxc"
+
+	// prepullContainerPrefix prefixes the names of the throwaway containers
+	// created to pre-pull images
+	prepullContainerPrefix = "nomad-prepull-"
+)
+
+// parseImageRef parses an image reference of the form
+// distro/release/arch[/variant]
+func parseImageRef(ref string) (imageKey, error) {
+	parts := strings.Split(ref, "/")
+	if len(parts) < 3 || len(parts) > 4 {
+		return imageKey{}, fmt.Errorf("invalid image %q, expected distro/release/arch[/variant]", ref)
+	}
+	for _, p := range parts {
+		if p == "" || p == "." || p == ".." {
+			return imageKey{}, fmt.Errorf("invalid image %q, expected distro/release/arch[/variant]", ref)
+		}
+	}
+
+	key := imageKey{distro: parts[0], release: parts[1], arch: parts[2], variant: defaultImageVariant}
+	if len(parts) == 4 {
+		key.variant = parts[3]
+	}
+	return key, nil
+}
+
+// parsePrepullImages validates the images to pre-pull from the driver config
+func parsePrepullImages(refs []string) ([]imageKey, error) {
+	keys := make([]imageKey, 0, len(refs))
+	for _, ref := range refs {
+		key, err := parseImageRef(ref)
+		if err != nil {
+			return nil, fmt.Errorf("prepull: %v", err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// imageAttributeReplacer escapes the dots of the parts of image attributes,
+// which separate the parts
+var imageAttributeReplacer = strings.NewReplacer(".", "_")
+
+// imageAttribute returns the node attribute advertising a cached image, such
+// as driver.lxc.image.ubuntu.jammy.amd64; the variant is only part of the
+// attribute if it isn't the default one. Dots in the parts are replaced with
+// underscores, so alpine/3.15/amd64 is driver.lxc.image.alpine.3_15.amd64.
+func imageAttribute(key imageKey) string {
+	parts := []string{key.distro, key.release, key.arch}
+	if key.variant != defaultImageVariant {
+		parts = append(parts, key.variant)
+	}
+	for i, p := range parts {
+		parts[i] = imageAttributeReplacer.Replace(p)
+	}
+	return "driver.lxc.image." + strings.Join(parts, ".")
+}
+
+// downloadCacheDir returns the cache directory of the download template
+func (d *Driver) downloadCacheDir() string {
+	if cache := d.currentImageCache(); cache != nil {
+		return cache.dir
+	}
+	if dir := os.Getenv(imageCacheEnv); dir != "" {
+		return dir
+	}
+	return defaultDownloadCacheDir
+}
+
+// imageAttributes returns the node attributes of the images cached on the
+// node, so that jobs can prefer nodes that won't need to download their image
+func (d *Driver) imageAttributes() map[string]*pstructs.Attribute {
+	dir := d.downloadCacheDir()
+	attrs := map[string]*pstructs.Attribute{}
+	for _, img := range listCachedImages(dir, false) {
+		if _, err := os.Stat(filepath.Join(img.key.path(dir), "rootfs.tar.xz")); err != nil {
+			// still downloading
+			continue
+		}
+		attrs[imageAttribute(img.key)] = pstructs.NewBoolAttribute(true)
+	}
+	return attrs
+}
+
+// prepullSet is the set of images pre-pulled or being pre-pulled since the
+// driver started
+type prepullSet struct {
+	lock sync.Mutex
+	keys map[imageKey]struct{}
+}
+
+func newPrepullSet() *prepullSet {
+	return &prepullSet{keys: map[imageKey]struct{}{}}
+}
+
+// add records keys and returns those that weren't in the set yet
+func (s *prepullSet) add(keys []imageKey) []imageKey {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var added []imageKey
+	for _, key := range keys {
+		if _, ok := s.keys[key]; ok {
+			continue
+		}
+		s.keys[key] = struct{}{}
+		added = append(added, key)
+	}
+	return added
+}
+
+// remove forgets key, so that the next config pre-pulls it again
+func (s *prepullSet) remove(key imageKey) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.keys, key)
+}
+
+// prepullImages downloads the images listed in the driver config into the
+// cache, so the first tasks using them don't wait for the download. The
+// download template only runs as part of creating a container, so a
+// throwaway container is created for each image.
+func (d *Driver) prepullImages(keys []imageKey) {
+	for _, key := range keys {
+		if d.ctx.Err() != nil {
+			return
+		}
+
+		if _, err := os.Stat(filepath.Join(key.path(d.downloadCacheDir()), "rootfs.tar.xz")); err == nil {
+			d.logger.Debug("image already cached", "image", key)
+			continue
+		}
+
+		d.logger.Info("pre-pulling image", "image", key)
+		v, err := d.prepullImage(key)
+		if err != nil {
+			d.logger.Error("failed to pre-pull image", "image", key, "error", err)
+			d.prepulled.remove(key)
+			continue
+		}
+		if v != nil {
+			d.logger.Info("pre-pulled image", "image", key, "build", v.Build, "gpg_signer", v.Signer)
+		} else {
+			d.logger.Info("pre-pulled image", "image", key)
+		}
+	}
+}
+
+// prepullImage downloads the image key into the cache. The verification of
+// the image is returned if the driver config has a keyring.
+func (d *Driver) prepullImage(key imageKey) (*imageVerification, error) {
+	lxcPath := d.lxcPath()
+	name := prepullContainerPrefix + strings.Join([]string{key.distro, key.release, key.arch, key.variant}, "-")
+
+	// a previous pre-pull may have been interrupted
+	if err := destroyContainer(name, lxcPath); err != nil {
+		return nil, err
+	}
+
+	c, err := lxc.NewContainer(name, lxcPath)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Release()
+
+	opts := lxc.TemplateOptions{
+		Template: downloadTemplate,
+		Distro:   key.distro,
+		Release:  key.release,
+		Arch:     key.arch,
+		Variant:  key.variant,
+	}
+	created, err := d.createRootfs(d.ctx, c, opts)
+	if err != nil {
+		destroyContainer(name, lxcPath)
+		return created.verification, err
+	}
+	return created.verification, c.Destroy()
+}
@@ -0,0 +1,97 @@
+package lxc
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// clockTicks is USER_HZ, the unit of process times in /proc; it is 100
+	// on every architecture Linux supports
+	clockTicks = 100
+)
+
+// bootTime returns the time the host booted, from /proc/stat
+func bootTime() (time.Time, error) {
+	f, err := os.Open("/proc/stat")
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "btime" {
+			secs, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return time.Time{}, err
+			}
+			return time.Unix(secs, 0), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return time.Time{}, err
+	}
+	return time.Time{}, fmt.Errorf("btime not found in /proc/stat")
+}
+
+// procStartTime returns the time process pid started
+func procStartTime(pid int) (time.Time, error) {
+	buf, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	ticks, err := parseProcStatStartTime(string(buf))
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	boot, err := bootTime()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return boot.Add(time.Duration(ticks) * time.Second / clockTicks), nil
+}
+
+// parseProcStatStartTime extracts the starttime field, in clock ticks since
+// boot, from the contents of /proc/<pid>/stat
+func parseProcStatStartTime(stat string) (uint64, error) {
+	// the command name is in parentheses and may contain spaces, so fields
+	// are counted from the last closing parenthesis
+	i := strings.LastIndexByte(stat, ')')
+	if i < 0 {
+		return 0, fmt.Errorf("malformed stat")
+	}
+
+	// fields after the command start with the state, which is field 3;
+	// starttime is field 22
+	fields := strings.Fields(stat[i+1:])
+	if len(fields) < 20 {
+		return 0, fmt.Errorf("malformed stat")
+	}
+	return strconv.ParseUint(fields[19], 10, 64)
+}
+
+// parseProcStatPpid extracts the parent pid from the contents of
+// /proc/<pid>/stat
+func parseProcStatPpid(stat string) (int, error) {
+	i := strings.LastIndexByte(stat, ')')
+	if i < 0 {
+		return 0, fmt.Errorf("malformed stat")
+	}
+
+	// ppid is field 4, right after the state
+	fields := strings.Fields(stat[i+1:])
+	if len(fields) < 2 {
+		return 0, fmt.Errorf("malformed stat")
+	}
+	return strconv.Atoi(fields[1])
+}
@@ -0,0 +1,225 @@
+package lxc
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	securejoin "github.com/cyphar/filepath-securejoin"
+	"github.com/hashicorp/nomad/client/lib/fifo"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	lxc "github.com/lxc/go-lxc"
+)
+
+// ProvisionConfig are the steps that prepare a newly created container before
+// the task starts. Files are copied into the rootfs first, then the commands
+// run in the container in order. Reused containers aren't provisioned again.
+type ProvisionConfig struct {
+	Files    []ProvisionFile `codec:"file"`
+	Commands [][]string      `codec:"commands"`
+}
+
+// ProvisionFile is a file or directory copied from the task directory into
+// the container rootfs
+type ProvisionFile struct {
+	Source      string `codec:"source"`
+	Destination string `codec:"destination"`
+}
+
+func (p ProvisionConfig) empty() bool {
+	return len(p.Files) == 0 && len(p.Commands) == 0
+}
+
+// validate checks the provision section of the task config
+func (p ProvisionConfig) validate() error {
+	for _, f := range p.Files {
+		if f.Source == "" {
+			return fmt.Errorf("lxc driver config 'provision' file requires a source")
+		}
+		if !filepath.IsAbs(f.Destination) {
+			return fmt.Errorf("lxc driver config 'provision' file destination must be an absolute path: %q", f.Destination)
+		}
+	}
+	for _, cmd := range p.Commands {
+		if len(cmd) == 0 || cmd[0] == "" {
+			return fmt.Errorf("lxc driver config 'provision' commands must not be empty")
+		}
+	}
+	return nil
+}
+
+// provisionSourcePath resolves the source of a provisioned file, which is
+// relative to the task directory as for volumes
+func (d *Driver) provisionSourcePath(cfg *drivers.TaskConfig, source string) (string, error) {
+	if filepath.IsAbs(source) {
+		if !d.currentConfig().AllowVolumes {
+			return "", fmt.Errorf("absolute 'provision' file source in config but volumes are disabled")
+		}
+		return source, nil
+	}
+
+	path := filepath.Join(cfg.TaskDir().Dir, source)
+	if !d.currentConfig().AllowVolumes && pathEscapesSandbox(cfg.TaskDir().Dir, path) {
+		return "", fmt.Errorf("'provision' file source escapes task directory but volumes are disabled")
+	}
+	return path, nil
+}
+
+// rootfsHostDir returns the host directory that files written to the rootfs
+// land in: the rootfs itself for directory backed containers, or the upper
+// layer of overlay containers. Other backing stores aren't mounted on the
+// host.
+func rootfsHostDir(paths []string) (string, error) {
+	store := rootfsBackingStore(paths)
+	switch store {
+	case "dir", "btrfs":
+		path := paths[0]
+		if i := strings.Index(path, ":"); i > 0 && path[:i] == store {
+			path = path[i+1:]
+		}
+		return path, nil
+	case "overlay":
+		path := paths[0]
+		return path[strings.LastIndex(path, ":")+1:], nil
+	case "":
+		return "", fmt.Errorf("container has no rootfs")
+	}
+	return "", fmt.Errorf("the rootfs of the %s backing store is not a host directory", store)
+}
+
+// rootfsLowerDir returns the lower layer of overlay rootfs paths, or an empty
+// string for other backing stores
+func rootfsLowerDir(paths []string) string {
+	if rootfsBackingStore(paths) != "overlay" {
+		return ""
+	}
+	path := paths[0]
+	return path[strings.Index(path, ":")+1 : strings.LastIndex(path, ":")]
+}
+
+// provisionContainer copies the files of the provision section into the
+// rootfs of c and runs its commands in the container. The output of the
+// commands goes to the task log, and the first failing step aborts.
+func (d *Driver) provisionContainer(ctx context.Context, c *lxc.Container, cfg *drivers.TaskConfig, p ProvisionConfig) error {
+	if len(p.Files) > 0 {
+		paths := c.ConfigItem("lxc.rootfs.path")
+		rootfs, err := rootfsHostDir(paths)
+		if err != nil {
+			return fmt.Errorf("cannot provision files: %v", err)
+		}
+		lower := rootfsLowerDir(paths)
+		for _, f := range p.Files {
+			src, err := d.provisionSourcePath(cfg, f.Source)
+			if err != nil {
+				return err
+			}
+			if err := copyIntoRootfs(ctx, src, rootfs, lower, f.Destination); err != nil {
+				return fmt.Errorf("failed to provision %s: %v", f.Destination, err)
+			}
+		}
+	}
+
+	if len(p.Commands) == 0 {
+		return nil
+	}
+
+	// lxc-execute reads the container config from disk, and the task
+	// settings are only held by c
+	confPath := filepath.Join(cfg.TaskDir().Dir, fmt.Sprintf("%v-provision.conf", cfg.Name))
+	if err := c.SaveConfigFile(confPath); err != nil {
+		return fmt.Errorf("failed to save container config: %v", err)
+	}
+	defer os.Remove(confPath)
+
+	stdout, stderr, err := openTaskLogs(cfg)
+	if err != nil {
+		return err
+	}
+	defer stdout.Close()
+	defer stderr.Close()
+
+	for _, cmd := range p.Commands {
+		fmt.Fprintf(stdout, "==> provision: %s\n", strings.Join(cmd, " "))
+
+		args := append([]string{"-n", c.Name(), "-P", d.lxcPath(), "-f", confPath, "--"}, cmd...)
+		command := exec.CommandContext(ctx, "lxc-execute", args...)
+		command.Stdout = stdout
+		command.Stderr = stderr
+		if err := command.Run(); err != nil {
+			return fmt.Errorf("provision command %q failed: %v", strings.Join(cmd, " "), err)
+		}
+	}
+	return nil
+}
+
+// copyIntoRootfs copies the file or directory src to dest within rootfs,
+// resolving dest as if rootfs was the root directory so that symlinks in the
+// rootfs can't point outside of it. If rootfs is the upper layer of an
+// overlay, lower is its lower layer.
+func copyIntoRootfs(ctx context.Context, src, rootfs, lower, dest string) error {
+	if _, err := os.Lstat(src); err != nil {
+		return err
+	}
+
+	if lower != "" {
+		// the upper layer only holds the files provisioned so far, so the
+		// parent of dest is resolved through the lower layer: creating it
+		// in the upper layer would otherwise shadow a symlink of the image,
+		// such as /bin on distributions with a merged /usr
+		parent, err := securejoin.SecureJoin(lower, filepath.Dir(dest))
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(lower, parent)
+		if err != nil {
+			return err
+		}
+		dest = filepath.Join("/", rel, filepath.Base(dest))
+	}
+
+	path, err := securejoin.SecureJoin(rootfs, dest)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	out, err := exec.CommandContext(ctx, "cp", "-a", "-T", src, path).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// openTaskLogs opens the stdout and stderr fifos of the task for writing.
+// Tasks without log fifos have their output discarded.
+func openTaskLogs(cfg *drivers.TaskConfig) (io.WriteCloser, io.WriteCloser, error) {
+	if cfg.StdoutPath == "" || cfg.StderrPath == "" {
+		return nopWriteCloser{ioutil.Discard}, nopWriteCloser{ioutil.Discard}, nil
+	}
+
+	stdout, err := fifo.OpenWriter(cfg.StdoutPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open task stdout: %v", err)
+	}
+	stderr, err := fifo.OpenWriter(cfg.StderrPath)
+	if err != nil {
+		stdout.Close()
+		return nil, nil, fmt.Errorf("failed to open task stderr: %v", err)
+	}
+	return stdout, stderr, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,127 @@
+package lxc
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLXCDriver_ProvisionValidate(t *testing.T) {
+	t.Parallel()
+
+	p := ProvisionConfig{
+		Files:    []ProvisionFile{{Source: "local/app.conf", Destination: "/etc/app.conf"}},
+		Commands: [][]string{{"apt-get", "update"}},
+	}
+	require.NoError(t, p.validate())
+	require.False(t, p.empty())
+	require.True(t, ProvisionConfig{}.empty())
+
+	p.Files[0].Destination = "etc/app.conf"
+	require.EqualError(t, p.validate(), `lxc driver config 'provision' file destination must be an absolute path: "etc/app.conf"`)
+
+	p.Files[0].Destination = "/etc/app.conf"
+	p.Commands = append(p.Commands, nil)
+	require.EqualError(t, p.validate(), "lxc driver config 'provision' commands must not be empty")
+}
+
+func TestLXCDriver_RootfsHostDir(t *testing.T) {
+	t.Parallel()
+
+	dir, err := rootfsHostDir([]string{"/var/lib/lxc/c1/rootfs"})
+	require.NoError(t, err)
+	require.Equal(t, "/var/lib/lxc/c1/rootfs", dir)
+
+	dir, err = rootfsHostDir([]string{"dir:/var/lib/lxc/c1/rootfs"})
+	require.NoError(t, err)
+	require.Equal(t, "/var/lib/lxc/c1/rootfs", dir)
+
+	dir, err = rootfsHostDir([]string{"btrfs:/var/lib/lxc/c1/rootfs"})
+	require.NoError(t, err)
+	require.Equal(t, "/var/lib/lxc/c1/rootfs", dir)
+
+	// files are written to the upper layer of overlays
+	dir, err = rootfsHostDir([]string{"overlay:/var/lib/lxc/base/rootfs:/var/lib/lxc/c1/delta0"})
+	require.NoError(t, err)
+	require.Equal(t, "/var/lib/lxc/c1/delta0", dir)
+
+	_, err = rootfsHostDir([]string{"zfs:lxc/c1"})
+	require.EqualError(t, err, "the rootfs of the zfs backing store is not a host directory")
+
+	_, err = rootfsHostDir(nil)
+	require.Error(t, err)
+}
+
+func TestLXCDriver_CopyIntoRootfs(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "lxc-provision")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "app.conf")
+	require.NoError(t, ioutil.WriteFile(src, []byte("listen 80\n"), 0600))
+
+	rootfs := filepath.Join(dir, "rootfs")
+	require.NoError(t, os.MkdirAll(rootfs, 0755))
+
+	// a symlink in the rootfs resolves within the rootfs, not on the host
+	outside := filepath.Join(dir, "outside")
+	require.NoError(t, os.MkdirAll(outside, 0755))
+	require.NoError(t, os.Symlink(outside, filepath.Join(rootfs, "etc")))
+
+	require.NoError(t, copyIntoRootfs(context.Background(), src, rootfs, "", "/etc/app/app.conf"))
+
+	buf, err := ioutil.ReadFile(filepath.Join(rootfs, outside, "app", "app.conf"))
+	require.NoError(t, err)
+	require.Equal(t, "listen 80\n", string(buf))
+	require.NoFileExists(t, filepath.Join(outside, "app", "app.conf"))
+
+	info, err := os.Stat(filepath.Join(rootfs, outside, "app", "app.conf"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	require.Error(t, copyIntoRootfs(context.Background(), filepath.Join(dir, "missing"), rootfs, "", "/missing"))
+}
+
+func TestLXCDriver_CopyIntoOverlayRootfs(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "lxc-provision")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "tool")
+	require.NoError(t, ioutil.WriteFile(src, []byte("#!/bin/sh\n"), 0755))
+
+	// /bin is a symlink in the image, as on distributions with a merged /usr
+	lower := filepath.Join(dir, "lower")
+	require.NoError(t, os.MkdirAll(filepath.Join(lower, "usr", "bin"), 0755))
+	require.NoError(t, os.Symlink("usr/bin", filepath.Join(lower, "bin")))
+	upper := filepath.Join(dir, "upper")
+	require.NoError(t, os.MkdirAll(upper, 0755))
+
+	require.NoError(t, copyIntoRootfs(context.Background(), src, upper, lower, "/bin/tool"))
+	require.FileExists(t, filepath.Join(upper, "usr", "bin", "tool"))
+
+	// a directory in the upper layer would hide the symlink in the container
+	_, err = os.Lstat(filepath.Join(upper, "bin"))
+	require.True(t, os.IsNotExist(err))
+
+	// directories missing from the image are created in the upper layer
+	require.NoError(t, copyIntoRootfs(context.Background(), src, upper, lower, "/opt/app/tool"))
+	require.FileExists(t, filepath.Join(upper, "opt", "app", "tool"))
+}
+
+func TestLXCDriver_RootfsLowerDir(t *testing.T) {
+	t.Parallel()
+
+	require.Equal(t, "/var/lib/lxc/base/rootfs", rootfsLowerDir([]string{"overlay:/var/lib/lxc/base/rootfs:/var/lib/lxc/c1/delta0"}))
+	require.Equal(t, "/var/lib/lxc/base/rootfs", rootfsLowerDir([]string{"overlayfs:/var/lib/lxc/base/rootfs:/var/lib/lxc/c1/delta0"}))
+	require.Empty(t, rootfsLowerDir([]string{"dir:/var/lib/lxc/c1/rootfs"}))
+	require.Empty(t, rootfsLowerDir(nil))
+}
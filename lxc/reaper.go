@@ -0,0 +1,243 @@
+package lxc
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	lxc "github.com/lxc/go-lxc"
+)
+
+const (
+	// defaultOrphanGracePeriod is how long a container must be unreferenced
+	// before the reaper destroys it
+	defaultOrphanGracePeriod = 1 * time.Hour
+
+	// defaultOrphanInterval is the interval at which lxc_path is scanned for
+	// orphaned containers
+	defaultOrphanInterval = 5 * time.Minute
+
+	// reuseFile is written in the directory of a container kept for the next
+	// run of a task with restart_mode reuse
+	reuseFile = "nomad-reuse.json"
+)
+
+// taskContainerNameRe matches the names given to task containers by
+// containerName, <task>-<alloc ID>
+var taskContainerNameRe = regexp.MustCompile(`^.+-[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+// orphanReaper keeps track of orphaned containers: containers in lxc_path
+// that follow the driver naming scheme but that no task references. These are
+// left behind if the client crashes between creating a container and tracking
+// its task, or if destroying a container fails.
+type orphanReaper struct {
+	// firstSeen records when each orphan was first found
+	firstSeen map[string]time.Time
+
+	// counters of reaper actions since the driver started
+	found     uint64
+	destroyed uint64
+	expired   uint64
+	failed    uint64
+
+	// lock serializes the reaper passes, which also run when a task is
+	// destroyed
+	lock sync.Mutex
+}
+
+func newOrphanReaper() *orphanReaper {
+	return &orphanReaper{
+		firstSeen: map[string]time.Time{},
+	}
+}
+
+// orphansDue records the orphans among names and returns those that have been
+// orphaned for longer than grace. Orphans that went away are forgotten.
+func (r *orphanReaper) orphansDue(names []string, referenced map[string]struct{}, now time.Time, grace time.Duration) ([]string, []string) {
+	var due, found []string
+	current := make(map[string]struct{}, len(names))
+
+	for _, name := range names {
+		if !taskContainerNameRe.MatchString(name) {
+			continue
+		}
+		if _, ok := referenced[name]; ok {
+			continue
+		}
+		current[name] = struct{}{}
+
+		first, ok := r.firstSeen[name]
+		if !ok {
+			r.firstSeen[name] = now
+			r.found++
+			found = append(found, name)
+			first = now
+		}
+		if now.Sub(first) >= grace {
+			due = append(due, name)
+		}
+	}
+
+	for name := range r.firstSeen {
+		if _, ok := current[name]; !ok {
+			delete(r.firstSeen, name)
+		}
+	}
+
+	return due, found
+}
+
+// runReaper periodically destroys orphaned containers until the driver shuts
+// down. The first scan happens one interval after the driver is configured,
+// leaving time for tasks to be recovered.
+func (d *Driver) runReaper() {
+	timer := time.NewTimer(d.currentConfig().GC.orphanInterval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		gc := d.currentConfig().GC
+		d.reap(gc)
+		timer.Reset(gc.orphanInterval)
+	}
+}
+
+// reap runs a reaper pass: retained containers are destroyed according to the
+// gc retention policy, and orphans once their grace period is over. Unpacked
+// rootfs that no container uses are removed after the same grace period.
+// Nothing is destroyed if container gc is disabled.
+func (d *Driver) reap(gc GCConfig) {
+	if !gc.Container {
+		// containers are kept on purpose
+		d.logger.Trace("not reaping containers, container gc is disabled")
+		return
+	}
+
+	d.reaper.lock.Lock()
+	defer d.reaper.lock.Unlock()
+
+	names := lxc.ContainerNames(d.lxcPath())
+	d.reapRetained(gc.retainPolicy(), names)
+	d.reapReused(names)
+	// the containers destroyed above no longer hold their rootfs
+	d.reapRootfsCache(lxc.ContainerNames(d.lxcPath()), gc.orphanGracePeriod)
+	if gc.Orphans {
+		d.reapOrphans(gc.orphanGracePeriod, names)
+	}
+}
+
+// reapOrphans stops and destroys the containers among names that have been
+// orphaned for longer than grace
+func (d *Driver) reapOrphans(grace time.Duration, names []string) {
+	lxcPath := d.lxcPath()
+
+	// retained containers aren't orphans even if they kept their task name
+	referenced := d.tasks.ContainerNames()
+	for name := range retainedNames(lxcPath, names) {
+		referenced[name] = struct{}{}
+	}
+
+	due, found := d.reaper.orphansDue(names, referenced, time.Now(), grace)
+
+	for _, name := range found {
+		d.logger.Info("found orphaned container", "container", name, "grace_period", grace, "orphans_found", d.reaper.found)
+	}
+
+	for _, name := range due {
+		if err := destroyContainer(name, lxcPath); err != nil {
+			d.reaper.failed++
+			d.logger.Error("failed to reap orphaned container", "container", name, "error", err, "reap_failures", d.reaper.failed)
+			continue
+		}
+
+		delete(d.reaper.firstSeen, name)
+		d.reaper.destroyed++
+		d.logger.Info("reaped orphaned container", "container", name, "orphans_reaped", d.reaper.destroyed)
+	}
+}
+
+// reusedContainer records the allocation of a container kept for reuse after
+// its task was destroyed
+type reusedContainer struct {
+	AllocDir string
+}
+
+// keepForReuse records the allocation of the container of a destroyed task
+// with restart_mode reuse. Nomad destroys the task after every run, so the
+// container is kept until the reaper finds that the allocation is gone.
+func (d *Driver) keepForReuse(h *taskHandle) error {
+	buf, err := json.Marshal(&reusedContainer{AllocDir: h.taskConfig.AllocDir})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(d.lxcPath(), h.container.Name(), reuseFile), buf, 0644)
+}
+
+// reusedDue returns the containers among names that were kept for reuse but
+// that no task references and whose allocation directory was removed: the
+// allocation won't run the task again.
+func reusedDue(lxcPath string, names []string, referenced map[string]struct{}) []string {
+	var due []string
+	for _, name := range names {
+		if _, ok := referenced[name]; ok {
+			continue
+		}
+		buf, err := ioutil.ReadFile(filepath.Join(lxcPath, name, reuseFile))
+		if err != nil {
+			continue
+		}
+		var rc reusedContainer
+		if err := json.Unmarshal(buf, &rc); err != nil || rc.AllocDir == "" {
+			continue
+		}
+		if _, err := os.Stat(rc.AllocDir); os.IsNotExist(err) {
+			due = append(due, name)
+		}
+	}
+	return due
+}
+
+// reapReused destroys the containers kept for reuse whose allocation is gone.
+// Unreferenced reused containers are also orphans, so with gc.orphans they
+// are destroyed after the orphan grace period at the latest.
+func (d *Driver) reapReused(names []string) {
+	lxcPath := d.lxcPath()
+	for _, name := range reusedDue(lxcPath, names, d.tasks.ContainerNames()) {
+		if err := destroyContainer(name, lxcPath); err != nil {
+			d.reaper.failed++
+			d.logger.Error("failed to destroy reused container", "container", name, "error", err, "reap_failures", d.reaper.failed)
+			continue
+		}
+
+		d.logger.Info("destroyed reused container of finished allocation", "container", name)
+	}
+}
+
+// destroyContainer stops the named container if it is running and destroys it
+func destroyContainer(name, lxcPath string) error {
+	c, err := lxc.NewContainer(name, lxcPath)
+	if err != nil {
+		return err
+	}
+	defer c.Release()
+
+	if c.Running() {
+		if err := c.Stop(); err != nil && !strings.Contains(err.Error(), "not running") {
+			return err
+		}
+	}
+	if !c.Defined() {
+		return nil
+	}
+	return c.Destroy()
+}
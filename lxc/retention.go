@@ -0,0 +1,206 @@
+package lxc
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+const (
+	// retentionFile is written in the directory of a container kept after its
+	// task is destroyed; the reaper enforces the gc retention policy on the
+	// containers that have one
+	retentionFile = "nomad-retention.json"
+)
+
+// retainedContainer describes a stopped container kept for inspection after
+// its task was destroyed
+type retainedContainer struct {
+	Name      string
+	Job       string
+	Task      string
+	AllocID   string
+	Failed    bool
+	StoppedAt time.Time
+
+	// Size is the disk usage of the container in bytes. A stopped container
+	// doesn't change, so it is measured once when the container is retained.
+	Size int64
+}
+
+// retainPolicy is the parsed retention part of the gc config
+type retainPolicy struct {
+	keepFailed time.Duration
+	keepLast   int
+	maxDisk    int64
+}
+
+func (c *GCConfig) retainPolicy() retainPolicy {
+	return retainPolicy{
+		keepFailed: c.keepFailed,
+		keepLast:   c.KeepLast,
+		maxDisk:    int64(c.MaxDiskMB) * 1024 * 1024,
+	}
+}
+
+// retains reports whether a container whose task exited with result should be
+// kept when its task is destroyed
+func (p retainPolicy) retains(result *drivers.ExitResult) bool {
+	if p.keepLast > 0 {
+		return true
+	}
+	return p.keepFailed > 0 && taskFailed(result)
+}
+
+// taskFailed reports whether result is the result of a failed task
+func taskFailed(result *drivers.ExitResult) bool {
+	return result == nil || !result.Successful() || result.OOMKilled
+}
+
+// retainContainer renames the stopped container of a destroyed task out of
+// the way of the next run of the task and records why it is kept. The
+// container is kept under its own name if renaming fails.
+func (d *Driver) retainContainer(h *taskHandle, result *drivers.ExitResult) error {
+	now := time.Now()
+	rc := retainedContainer{
+		Name:      fmt.Sprintf("%s-%d", h.container.Name(), now.Unix()),
+		Job:       h.taskConfig.JobName,
+		Task:      h.taskConfig.Name,
+		AllocID:   h.taskConfig.AllocID,
+		Failed:    taskFailed(result),
+		StoppedAt: now,
+	}
+
+	if err := h.container.Rename(rc.Name); err != nil {
+		h.logger.Warn("failed to rename retained container", "container", h.container.Name(), "error", err)
+		rc.Name = h.container.Name()
+	}
+
+	rc.Size = dirSize(filepath.Join(d.lxcPath(), rc.Name))
+	return writeRetention(d.lxcPath(), &rc)
+}
+
+// writeRetention writes the retention record of rc in its container directory
+func writeRetention(lxcPath string, rc *retainedContainer) error {
+	buf, err := json.Marshal(rc)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(lxcPath, rc.Name, retentionFile), buf, 0644)
+}
+
+// loadRetainedContainers returns the retained containers among names. With
+// withSize, containers whose record has no size are measured once and their
+// record updated.
+func loadRetainedContainers(lxcPath string, names []string, withSize bool) []*retainedContainer {
+	var retained []*retainedContainer
+	for _, name := range names {
+		buf, err := ioutil.ReadFile(filepath.Join(lxcPath, name, retentionFile))
+		if err != nil {
+			continue
+		}
+
+		var rc retainedContainer
+		if err := json.Unmarshal(buf, &rc); err != nil {
+			continue
+		}
+		rc.Name = name
+		if withSize && rc.Size == 0 {
+			rc.Size = dirSize(filepath.Join(lxcPath, name))
+			writeRetention(lxcPath, &rc)
+		}
+		retained = append(retained, &rc)
+	}
+	return retained
+}
+
+// retentionDue returns the names of the retained containers that the policy
+// no longer keeps: failed containers older than keepFailed that aren't among
+// the keepLast most recent of their job, and then the oldest containers until
+// the total disk usage is under maxDisk.
+func retentionDue(retained []*retainedContainer, p retainPolicy, now time.Time) []string {
+	// newest first
+	sorted := make([]*retainedContainer, len(retained))
+	copy(sorted, retained)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].StoppedAt.After(sorted[j].StoppedAt)
+	})
+
+	var due []string
+	var kept []*retainedContainer
+	perJob := map[string]int{}
+	for _, rc := range sorted {
+		perJob[rc.Job]++
+		keep := perJob[rc.Job] <= p.keepLast ||
+			(rc.Failed && now.Sub(rc.StoppedAt) < p.keepFailed)
+		if keep {
+			kept = append(kept, rc)
+		} else {
+			due = append(due, rc.Name)
+		}
+	}
+
+	if p.maxDisk <= 0 {
+		return due
+	}
+
+	var total int64
+	for _, rc := range kept {
+		total += rc.Size
+	}
+	for i := len(kept) - 1; i >= 0 && total > p.maxDisk; i-- {
+		due = append(due, kept[i].Name)
+		total -= kept[i].Size
+	}
+	return due
+}
+
+// reapRetained destroys the retained containers that the gc retention policy
+// no longer keeps
+func (d *Driver) reapRetained(p retainPolicy, names []string) {
+	lxcPath := d.lxcPath()
+	retained := loadRetainedContainers(lxcPath, names, p.maxDisk > 0)
+
+	for _, name := range retentionDue(retained, p, time.Now()) {
+		if err := destroyContainer(name, lxcPath); err != nil {
+			d.reaper.failed++
+			d.logger.Error("failed to destroy retained container", "container", name, "error", err, "reap_failures", d.reaper.failed)
+			continue
+		}
+
+		d.reaper.expired++
+		d.logger.Info("destroyed retained container", "container", name, "retained_reaped", d.reaper.expired)
+	}
+}
+
+// retainedNames returns the set of names of the retained containers among names
+func retainedNames(lxcPath string, names []string) map[string]struct{} {
+	set := map[string]struct{}{}
+	for _, name := range names {
+		if _, err := os.Stat(filepath.Join(lxcPath, name, retentionFile)); err == nil {
+			set[name] = struct{}{}
+		}
+	}
+	return set
+}
+
+// dirSize returns the disk usage of the files under dir, ignoring errors
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
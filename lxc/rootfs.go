@@ -0,0 +1,310 @@
+package lxc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+	lxc "github.com/lxc/go-lxc"
+)
+
+const (
+	// rootfsCacheDir is the directory of lxc_path where rootfs tarballs are
+	// unpacked, one directory per tarball digest. liblxc ignores directories
+	// without a container config. The reaper removes the unpacked rootfs
+	// that no container uses once they have been unused for the orphan
+	// grace period.
+	rootfsCacheDir = ".nomad-rootfs"
+
+	// rootfsCompleteFile marks a fully unpacked rootfs in the cache; its
+	// modification time is the last time a task used the rootfs
+	rootfsCompleteFile = ".nomad-complete"
+)
+
+// validateRootfs checks the rootfs options of a task. A task either has a
+// template or a rootfs.
+func validateRootfs(taskConfig TaskConfig) error {
+	if taskConfig.Rootfs == "" {
+		if taskConfig.RootfsChecksum != "" {
+			return fmt.Errorf("lxc driver config 'rootfs_checksum' requires 'rootfs'")
+		}
+		return nil
+	}
+
+	if taskConfig.Template != "" {
+		return fmt.Errorf("lxc driver config 'template' and 'rootfs' are mutually exclusive")
+	}
+	if taskConfig.BackingStore != "" {
+		return fmt.Errorf("lxc driver config 'backingstore' is not supported with 'rootfs'")
+	}
+	if taskConfig.RootfsChecksum != "" {
+		if _, err := parseRootfsChecksum(taskConfig.RootfsChecksum); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseRootfsChecksum returns the hex sha256 digest of a "sha256:<hex>"
+// checksum
+func parseRootfsChecksum(checksum string) (string, error) {
+	parts := strings.SplitN(checksum, ":", 2)
+	if len(parts) != 2 || parts[0] != "sha256" {
+		return "", fmt.Errorf("lxc driver config 'rootfs_checksum' must be of the form sha256:<hex digest>")
+	}
+	digest := strings.ToLower(parts[1])
+	if _, err := hex.DecodeString(digest); err != nil || len(digest) != sha256.Size*2 {
+		return "", fmt.Errorf("lxc driver config 'rootfs_checksum' is not a valid sha256 digest: %q", parts[1])
+	}
+	return digest, nil
+}
+
+// rootfsSourcePath resolves the rootfs path of the task, which is relative to
+// the task directory as for volumes
+func (d *Driver) rootfsSourcePath(cfg *drivers.TaskConfig, taskConfig TaskConfig) (string, error) {
+	path := taskConfig.Rootfs
+	if filepath.IsAbs(path) {
+		if !d.currentConfig().AllowVolumes {
+			return "", fmt.Errorf("absolute 'rootfs' path in config but volumes are disabled")
+		}
+		return path, nil
+	}
+
+	path = filepath.Join(cfg.TaskDir().Dir, path)
+	if !d.currentConfig().AllowVolumes && pathEscapesSandbox(cfg.TaskDir().Dir, path) {
+		return "", fmt.Errorf("'rootfs' path escapes task directory but volumes are disabled")
+	}
+	return path, nil
+}
+
+// prepareRootfs returns the directory to use as the lower layer of the
+// container rootfs. Directories are used in place; tarballs are verified
+// against the checksum, which they require, and unpacked into the cache keyed by their
+// digest. The returned bool is true if the tarball was already unpacked.
+func (d *Driver) prepareRootfs(ctx context.Context, cfg *drivers.TaskConfig, taskConfig TaskConfig) (string, bool, error) {
+	if !d.currentConfig().BackingStore.allowed("overlay") {
+		return "", false, fmt.Errorf("lxc driver config 'rootfs' requires the overlay backing store, which is not allowed on this node")
+	}
+
+	src, err := d.rootfsSourcePath(cfg, taskConfig)
+	if err != nil {
+		return "", false, err
+	}
+
+	info, err := os.Stat(src)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to find rootfs: %v", err)
+	}
+	if info.IsDir() {
+		if taskConfig.RootfsChecksum != "" {
+			return "", false, fmt.Errorf("lxc driver config 'rootfs_checksum' is only supported for rootfs tarballs")
+		}
+		return src, false, nil
+	}
+
+	// tarballs are fetched as artifacts, and are only unpacked once verified
+	if taskConfig.RootfsChecksum == "" {
+		return "", false, fmt.Errorf("lxc driver config 'rootfs_checksum' is required for rootfs tarballs")
+	}
+	expected, err := parseRootfsChecksum(taskConfig.RootfsChecksum)
+	if err != nil {
+		return "", false, err
+	}
+	digest, err := fileSHA256(src)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to checksum rootfs: %v", err)
+	}
+	if digest != expected {
+		return "", false, fmt.Errorf("rootfs checksum mismatch: expected sha256:%s, got sha256:%s", expected, digest)
+	}
+
+	unlock := d.rootfsLocks.lock(digest)
+	defer unlock()
+
+	dir := filepath.Join(d.lxcPath(), rootfsCacheDir, digest)
+	complete := filepath.Join(dir, rootfsCompleteFile)
+	if _, err := os.Stat(complete); err == nil {
+		// keep the reaper off the rootfs until the container uses it
+		now := time.Now()
+		if err := os.Chtimes(complete, now, now); err != nil {
+			return "", false, fmt.Errorf("failed to mark rootfs as used: %v", err)
+		}
+		return dir, true, nil
+	}
+
+	if err := unpackRootfs(ctx, src, dir); err != nil {
+		return "", false, err
+	}
+	return dir, false, nil
+}
+
+// unpackRootfs unpacks the tarball src into dir. The tarball is unpacked into
+// a temporary directory first so that dir is only ever complete.
+func unpackRootfs(ctx context.Context, src, dir string) error {
+	if err := os.MkdirAll(filepath.Dir(dir), 0700); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempDir(filepath.Dir(dir), filepath.Base(dir)+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	// tar detects the compression and restores ownership, permissions,
+	// device nodes and extended attributes, which a rootfs needs
+	out, err := exec.CommandContext(ctx, "tar", "--numeric-owner", "--xattrs", "--xattrs-include=*",
+		"-xpf", src, "-C", tmp).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to unpack rootfs: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	// the rootfs lives in the temporary directory, which must be traversable
+	if err := os.Chmod(tmp, 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmp, rootfsCompleteFile), nil, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, dir)
+}
+
+// rootfsCacheDue returns the digests of the unpacked rootfs in the cache of
+// lxcPath that none of the containers in names uses as its lower layer and
+// that no task used for grace. Rootfs still being unpacked have no
+// completion mark and are left alone.
+func rootfsCacheDue(lxcPath string, names []string, now time.Time, grace time.Duration) []string {
+	cacheDir := filepath.Join(lxcPath, rootfsCacheDir)
+	entries, err := ioutil.ReadDir(cacheDir)
+	if err != nil {
+		return nil
+	}
+
+	used := map[string]struct{}{}
+	for _, name := range names {
+		if lower := rootfsLowerDir([]string{containerRootfsPath(lxcPath, name)}); lower != "" {
+			used[filepath.Clean(lower)] = struct{}{}
+		}
+	}
+
+	var due []string
+	for _, e := range entries {
+		dir := filepath.Join(cacheDir, e.Name())
+		if _, ok := used[dir]; ok {
+			continue
+		}
+		if rootfsUnusedFor(dir, now, grace) {
+			due = append(due, e.Name())
+		}
+	}
+	return due
+}
+
+// rootfsUnusedFor reports whether the unpacked rootfs at dir is complete and
+// was last used by a task more than grace before now
+func rootfsUnusedFor(dir string, now time.Time, grace time.Duration) bool {
+	info, err := os.Stat(filepath.Join(dir, rootfsCompleteFile))
+	return err == nil && now.Sub(info.ModTime()) >= grace
+}
+
+// containerRootfsPath reads lxc.rootfs.path from the config file of the named
+// container, without loading the container
+func containerRootfsPath(lxcPath, name string) string {
+	buf, err := ioutil.ReadFile(filepath.Join(lxcPath, name, "config"))
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(buf), "\n") {
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) == 2 && strings.TrimSpace(parts[0]) == "lxc.rootfs.path" {
+			return strings.TrimSpace(parts[1])
+		}
+	}
+	return ""
+}
+
+// reapRootfsCache removes the unpacked rootfs that no container among names
+// uses and that no task used for grace
+func (d *Driver) reapRootfsCache(names []string, grace time.Duration) {
+	lxcPath := d.lxcPath()
+	for _, digest := range rootfsCacheDue(lxcPath, names, time.Now(), grace) {
+		dir := filepath.Join(lxcPath, rootfsCacheDir, digest)
+
+		// a task may have picked the rootfs up since it was found unused
+		unlock := d.rootfsLocks.lock(digest)
+		var err error
+		if rootfsUnusedFor(dir, time.Now(), grace) {
+			err = os.RemoveAll(dir)
+		}
+		unlock()
+
+		if err != nil {
+			d.reaper.failed++
+			d.logger.Error("failed to remove unused rootfs", "digest", digest, "error", err, "reap_failures", d.reaper.failed)
+			continue
+		}
+		d.logger.Info("removed unused rootfs", "digest", digest)
+	}
+}
+
+// fileSHA256 returns the hex sha256 digest of the file at path
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// defineRootfsContainer defines the container c, whose config was initialized
+// by initializeContainer, without running a template. Its rootfs is an
+// overlay with lower as the read-only lower layer, so that the cached rootfs
+// is shared between containers and never modified.
+func (d *Driver) defineRootfsContainer(c *lxc.Container, lower string) error {
+	return d.defineOverlayContainer(c, lower, filepath.Join(d.lxcPath(), c.Name(), "delta0"))
+}
+
+// defineOverlayContainer defines c with an overlay rootfs of the lower and
+// upper directories. liblxc puts the overlay work directory next to upper.
+// The container directory is removed if c can't be defined.
+func (d *Driver) defineOverlayContainer(c *lxc.Container, lower, upper string) (err error) {
+	dir := filepath.Join(d.lxcPath(), c.Name())
+	defer func() {
+		if err != nil {
+			os.RemoveAll(dir)
+		}
+	}()
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create container directory: %v", err)
+	}
+	if err := os.MkdirAll(upper, 0755); err != nil {
+		return fmt.Errorf("failed to create overlay upper directory: %v", err)
+	}
+
+	if err := c.SetConfigItem("lxc.rootfs.path", fmt.Sprintf("overlay:%s:%s", lower, upper)); err != nil {
+		return fmt.Errorf("failed to set container rootfs: %v", err)
+	}
+	if err := c.SaveConfigFile(filepath.Join(dir, "config")); err != nil {
+		return fmt.Errorf("failed to save container config: %v", err)
+	}
+	return nil
+}
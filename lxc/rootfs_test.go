@@ -0,0 +1,151 @@
+package lxc
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/nomad/helper/testlog"
+	"github.com/hashicorp/nomad/helper/uuid"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	lxc "github.com/lxc/go-lxc"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLXCDriver_ValidateRootfs(t *testing.T) {
+	t.Parallel()
+
+	checksum := "sha256:" + hex.EncodeToString(make([]byte, sha256.Size))
+	require.NoError(t, validateRootfs(TaskConfig{Rootfs: "local/rootfs.tar.gz", RootfsChecksum: checksum}))
+
+	require.EqualError(t, validateRootfs(TaskConfig{Rootfs: "rootfs", Template: "busybox"}),
+		"lxc driver config 'template' and 'rootfs' are mutually exclusive")
+	require.EqualError(t, validateRootfs(TaskConfig{RootfsChecksum: checksum}),
+		"lxc driver config 'rootfs_checksum' requires 'rootfs'")
+	require.EqualError(t, validateRootfs(TaskConfig{Rootfs: "rootfs", RootfsChecksum: "md5:abcd"}),
+		"lxc driver config 'rootfs_checksum' must be of the form sha256:<hex digest>")
+	require.Error(t, validateRootfs(TaskConfig{Rootfs: "rootfs", RootfsChecksum: "sha256:abcd"}))
+
+	_, err := toLXCCreateOptions(TaskConfig{})
+	require.EqualError(t, err, "lxc driver config requires either 'template' or 'rootfs'")
+}
+
+func TestLXCDriver_PrepareRootfs(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "lxc-rootfs")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// a minimal rootfs tarball
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755}))
+	content := []byte("rootfs\n")
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "etc/hostname", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))}))
+	_, err = tw.Write(content)
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+
+	tarball := filepath.Join(dir, "rootfs.tar")
+	require.NoError(t, ioutil.WriteFile(tarball, buf.Bytes(), 0644))
+	sum := sha256.Sum256(buf.Bytes())
+	digest := hex.EncodeToString(sum[:])
+
+	d := NewLXCDriver(testlog.HCLogger(t)).(*Driver)
+	d.config.AllowVolumes = true
+	d.config.LXCPath = filepath.Join(dir, "lxc")
+
+	task := &drivers.TaskConfig{ID: uuid.Generate(), Name: "test"}
+	taskConfig := TaskConfig{Rootfs: tarball, RootfsChecksum: "sha256:" + digest}
+
+	lower, cached, err := d.prepareRootfs(context.Background(), task, taskConfig)
+	require.NoError(t, err)
+	require.False(t, cached)
+	require.Equal(t, filepath.Join(dir, "lxc", rootfsCacheDir, digest), lower)
+	require.FileExists(t, filepath.Join(lower, "etc", "hostname"))
+
+	// the tarball is only unpacked once
+	_, cached, err = d.prepareRootfs(context.Background(), task, taskConfig)
+	require.NoError(t, err)
+	require.True(t, cached)
+
+	taskConfig.RootfsChecksum = "sha256:" + hex.EncodeToString(make([]byte, sha256.Size))
+	_, _, err = d.prepareRootfs(context.Background(), task, taskConfig)
+	require.Contains(t, err.Error(), "rootfs checksum mismatch")
+
+	// unverified tarballs aren't unpacked, even if already cached
+	taskConfig.RootfsChecksum = ""
+	_, _, err = d.prepareRootfs(context.Background(), task, taskConfig)
+	require.EqualError(t, err, "lxc driver config 'rootfs_checksum' is required for rootfs tarballs")
+}
+
+func TestLXCDriver_RootfsCacheDue(t *testing.T) {
+	t.Parallel()
+
+	lxcPath, err := ioutil.TempDir("", "lxc-rootfs")
+	require.NoError(t, err)
+	defer os.RemoveAll(lxcPath)
+
+	now := time.Now()
+	old := now.Add(-2 * time.Hour)
+	for _, digest := range []string{"used", "unused", "recent"} {
+		dir := filepath.Join(lxcPath, rootfsCacheDir, digest)
+		require.NoError(t, os.MkdirAll(dir, 0755))
+		complete := filepath.Join(dir, rootfsCompleteFile)
+		require.NoError(t, ioutil.WriteFile(complete, nil, 0644))
+		if digest != "recent" {
+			require.NoError(t, os.Chtimes(complete, old, old))
+		}
+	}
+	// a tarball still being unpacked
+	require.NoError(t, os.MkdirAll(filepath.Join(lxcPath, rootfsCacheDir, "unpacking.tmp-1"), 0755))
+
+	// a container with an overlay over the used rootfs, and one with a rootfs
+	// of its own
+	require.NoError(t, os.MkdirAll(filepath.Join(lxcPath, "c1"), 0755))
+	config := fmt.Sprintf("lxc.uts.name = c1\nlxc.rootfs.path = overlay:%s:%s\n",
+		filepath.Join(lxcPath, rootfsCacheDir, "used"), filepath.Join(lxcPath, "c1", "delta0"))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(lxcPath, "c1", "config"), []byte(config), 0644))
+	require.NoError(t, os.MkdirAll(filepath.Join(lxcPath, "c2"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(lxcPath, "c2", "config"),
+		[]byte("lxc.rootfs.path = dir:"+filepath.Join(lxcPath, "c2", "rootfs")+"\n"), 0644))
+
+	names := []string{"c1", "c2"}
+	require.Equal(t, []string{"unused"}, rootfsCacheDue(lxcPath, names, now, time.Hour))
+
+	// once its container is gone the rootfs is unused too
+	require.ElementsMatch(t, []string{"used", "unused"}, rootfsCacheDue(lxcPath, names[1:], now, time.Hour))
+}
+
+func TestLXCDriver_DefineOverlayContainerCleanup(t *testing.T) {
+	t.Parallel()
+	requireLXC(t)
+
+	dir, err := ioutil.TempDir("", "lxc-rootfs")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	d := NewLXCDriver(testlog.HCLogger(t)).(*Driver)
+	d.config.LXCPath = filepath.Join(dir, "lxc")
+
+	c, err := lxc.NewContainer("test-"+uuid.Generate(), d.lxcPath())
+	require.NoError(t, err)
+	defer c.Release()
+
+	// the upper directory can't be created below a file
+	file := filepath.Join(dir, "file")
+	require.NoError(t, ioutil.WriteFile(file, nil, 0644))
+
+	err = d.defineOverlayContainer(c, filepath.Join(dir, "lower"), filepath.Join(file, "upper"))
+	require.Contains(t, err.Error(), "failed to create overlay upper directory")
+	require.NoDirExists(t, filepath.Join(d.lxcPath(), c.Name()))
+}
@@ -31,3 +31,38 @@ func (ts *taskStore) Delete(id string) {
 	defer ts.lock.Unlock()
 	delete(ts.store, id)
 }
+
+// ContainerNames returns the set of container names of all tasks
+func (ts *taskStore) ContainerNames() map[string]struct{} {
+	ts.lock.RLock()
+	defer ts.lock.RUnlock()
+	names := make(map[string]struct{}, len(ts.store))
+	for _, h := range ts.store {
+		names[h.container.Name()] = struct{}{}
+	}
+	return names
+}
+
+// keyedMutex is a set of mutexes identified by keys
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+func newKeyedMutex() *keyedMutex {
+	return &keyedMutex{locks: map[string]*sync.Mutex{}}
+}
+
+// lock locks the mutex of key and returns the unlock function
+func (k *keyedMutex) lock(key string) func() {
+	k.mu.Lock()
+	l, ok := k.locks[key]
+	if !ok {
+		l = &sync.Mutex{}
+		k.locks[key] = l
+	}
+	k.mu.Unlock()
+
+	l.Lock()
+	return l.Unlock
+}